@@ -0,0 +1,494 @@
+package lsm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/irqlevel/naiv/lib/common/log"
+	"github.com/irqlevel/naiv/lib/common/vfs"
+)
+
+var (
+	ErrRestoreTargetExists = fmt.Errorf("Restore target already exists")
+	ErrRestoreGap          = fmt.Errorf("Archive misses records")
+	archiveFileNamePattern = regexp.MustCompile(`^lsm\_([0-9]+)\.wal$`)
+)
+
+const (
+	archiveDirName = "archive"
+)
+
+func getArchiveSegmentPath(archivePath string, index int64) string {
+	return path.Join(archivePath, "lsm_"+strconv.FormatInt(index, 10)+".wal")
+}
+
+func listFileIndexes(fs vfs.FS, dirPath string, pattern *regexp.Regexp) ([]int64, error) {
+	files, err := fs.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, 0)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		match := pattern.FindStringSubmatch(file.Name())
+		if match == nil || len(match) == 1 {
+			continue
+		}
+
+		index, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, index)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// archiveLog moves the current log into archive segment id, which holds
+// exactly the records flushed into table id, and starts an empty log.
+func (lsm *Lsm) archiveLog(id int64) error {
+	logPath := filepath.Join(lsm.rootPath, logFileName)
+
+	err := lsm.logFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = lsm.logFile.Close()
+	if err != nil {
+		return err
+	}
+
+	err = lsm.fs.Rename(logPath, getArchiveSegmentPath(lsm.opts.ArchivePath, id))
+	if err == nil {
+		err = lsm.fs.SyncDir(lsm.opts.ArchivePath)
+	}
+	if err != nil {
+		return err
+	}
+
+	logFile, err := lsm.fs.OpenFile(logPath, os.O_APPEND|os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	lsm.logFile = logFile
+	lsm.log.Pf(0, "archived log segment %d", id)
+
+	if lsm.opts.ArchiveRetention > 0 {
+		err = lsm.expireArchive(time.Now().Add(-lsm.opts.ArchiveRetention))
+		if err != nil {
+			lsm.log.Pf(0, "expire archive error %v", err)
+		}
+	}
+
+	err = lsm.startLog()
+	if err != nil {
+		return err
+	}
+	return lsm.fs.SyncDir(lsm.rootPath)
+}
+
+// expireArchive removes the archived segments last written before cutoff,
+// oldest first.
+func (lsm *Lsm) expireArchive(cutoff time.Time) error {
+	ids, err := listFileIndexes(lsm.fs, lsm.opts.ArchivePath, archiveFileNamePattern)
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, id := range ids {
+		segmentPath := getArchiveSegmentPath(lsm.opts.ArchivePath, id)
+		info, err := lsm.fs.Stat(segmentPath)
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Before(cutoff) {
+			break
+		}
+
+		err = lsm.fs.Remove(segmentPath)
+		if err != nil {
+			return err
+		}
+		removed++
+	}
+
+	if removed == 0 {
+		return nil
+	}
+	lsm.log.Pf(0, "expired %d archived log segments", removed)
+	return lsm.fs.SyncDir(lsm.opts.ArchivePath)
+}
+
+// PruneArchive removes the archived log segments which hold no record after
+// seq. RestoreLsm of a backup needs the records after the highest sequence
+// of the backup, so seq is that of the oldest backup kept. Subscriptions
+// which are further behind fail with ErrSequenceNotRetained.
+func (lsm *Lsm) PruneArchive(seq uint64) error {
+	if lsm.readOnly {
+		return ErrReadOnly
+	}
+
+	lsm.nodeMapLock.Lock()
+	defer lsm.nodeMapLock.Unlock()
+
+	ids, err := listFileIndexes(lsm.fs, lsm.opts.ArchivePath, archiveFileNamePattern)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	// A segment holds the records before the first one of the files which
+	// follow it, the log is the last of them
+	paths := make([]string, 0, len(ids)+1)
+	for _, id := range ids {
+		paths = append(paths, getArchiveSegmentPath(lsm.opts.ArchivePath, id))
+	}
+	paths = append(paths, filepath.Join(lsm.rootPath, logFileName))
+
+	nextSeqs := make([]uint64, len(paths))
+	nextSeq := lsm.seq + 1
+	for i := len(paths) - 1; i >= 0; i-- {
+		nextSeqs[i] = nextSeq
+		firstSeq, err := readFirstSeq(lsm, paths[i])
+		if err != nil {
+			if err == io.EOF {
+				continue
+			}
+			return err
+		}
+		nextSeq = firstSeq
+	}
+
+	removed := 0
+	for i := range ids {
+		if nextSeqs[i] > seq+1 {
+			break
+		}
+		err = lsm.fs.Remove(paths[i])
+		if err != nil {
+			return err
+		}
+		removed++
+	}
+
+	if removed == 0 {
+		return nil
+	}
+	lsm.log.Pf(0, "pruned %d archived log segments up to seq %d", removed, seq)
+	return lsm.fs.SyncDir(lsm.opts.ArchivePath)
+}
+
+func copyFile(fs vfs.FS, srcPath string, dstPath string) error {
+	src, err := fs.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := fs.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		fs.Remove(dstPath)
+		return err
+	}
+
+	err = dst.Sync()
+	if err != nil {
+		dst.Close()
+		fs.Remove(dstPath)
+		return err
+	}
+
+	return dst.Close()
+}
+
+// Backup copies the tables and the log into dstPath. Writers are blocked
+// while the copy is made, so the backup is a consistent base for RestoreLsm.
+func (lsm *Lsm) Backup(dstPath string) error {
+	lsm.nodeMapLock.Lock()
+	defer lsm.nodeMapLock.Unlock()
+
+	lsm.ssTableMapLock.RLock()
+	defer lsm.ssTableMapLock.RUnlock()
+
+	lsm.log.Pf(0, "backup to %s", dstPath)
+
+	err := lsm.fs.MkdirAll(dstPath, 0700)
+	if err != nil {
+		return err
+	}
+
+	for id, st := range lsm.ssTableMap {
+		err = copyFile(lsm.fs, st.filePath, path.Join(dstPath, "lsm_"+strconv.FormatInt(id, 10)+".sstable"))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, family := range lsm.families {
+		err = family.backupTables(getFamilyPath(dstPath, family.family.Id))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = copyManifest(lsm.fs, lsm.rootPath, dstPath)
+	if err != nil {
+		return err
+	}
+
+	err = copyFile(lsm.fs, filepath.Join(lsm.rootPath, logFileName), filepath.Join(dstPath, logFileName))
+	if err != nil {
+		return err
+	}
+
+	lsm.log.Pf(0, "backup to %s done", dstPath)
+	return nil
+}
+
+func (lsm *Lsm) backupTables(dstPath string) error {
+	lsm.ssTableMapLock.RLock()
+	defer lsm.ssTableMapLock.RUnlock()
+
+	err := lsm.fs.MkdirAll(dstPath, 0700)
+	if err != nil {
+		return err
+	}
+
+	for id, st := range lsm.ssTableMap {
+		err = copyFile(lsm.fs, st.filePath, path.Join(dstPath, "lsm_"+strconv.FormatInt(id, 10)+".sstable"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreTables copies the tables of backupPath into dstPath and returns the
+// highest sequence they hold.
+func restoreTables(fs vfs.FS, log log.LogInterface, codec nodeCodec, backupPath string, dstPath string) (uint64, error) {
+	err := fs.MkdirAll(dstPath, 0700)
+	if err != nil {
+		return 0, err
+	}
+
+	tableIds, err := listFileIndexes(fs, backupPath, ssTableFileNamePattern)
+	if err != nil {
+		return 0, err
+	}
+
+	maxSeq := uint64(0)
+	for _, id := range tableIds {
+		name := "lsm_" + strconv.FormatInt(id, 10) + ".sstable"
+		st, err := openSsTable(fs, log, path.Join(backupPath, name), codec)
+		if err != nil {
+			return 0, err
+		}
+		if st.maxSeq > maxSeq {
+			maxSeq = st.maxSeq
+		}
+		st.Close()
+
+		err = copyFile(fs, path.Join(backupPath, name), path.Join(dstPath, name))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return maxSeq, nil
+}
+
+// restoreReplayer appends records to the restored log in sequence order up
+// to the requested point.
+type restoreReplayer struct {
+	fs        vfs.FS
+	codec     nodeCodec
+	logFile   *countingWriter
+	logCipher *fileCipher
+	// baseSeqs holds the highest sequence in the tables of each family,
+	// their records up to it are skipped. A family flush leaves older
+	// records of the others in the log.
+	baseSeqs       map[uint32]uint64
+	baseSeq        uint64
+	lastSeq        uint64
+	untilSeq       uint64
+	untilTimestamp int64
+	count          int64
+	done           bool
+}
+
+func (r *restoreReplayer) replay(filePath string) error {
+	file, err := r.fs.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	nr, err := openNodeReader(file, filePath, r.codec)
+	if err != nil {
+		return err
+	}
+
+	for !r.done {
+		n, err := nr.next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		// Segments and the backup log may hold the same records
+		if n.seq <= r.lastSeq {
+			continue
+		}
+
+		// Every record after the tables must be there, a lost segment
+		// would leave writes out
+		if r.lastSeq <= r.baseSeq && n.seq > r.baseSeq+1 {
+			return fmt.Errorf("%w: sequence %d follows %d", ErrRestoreGap, n.seq, r.baseSeq)
+		}
+
+		if n.seq <= r.baseSeqs[n.family] {
+			r.lastSeq = n.seq
+			continue
+		}
+
+		if (r.untilSeq != 0 && n.seq > r.untilSeq) ||
+			(r.untilTimestamp != 0 && n.timestamp > r.untilTimestamp) {
+			r.done = true
+			break
+		}
+
+		err = n.writeTo(r.logFile, r.logCipher, r.logFile.n)
+		if err != nil {
+			return err
+		}
+		r.lastSeq = n.seq
+		r.count++
+	}
+
+	return nil
+}
+
+// RestoreLsm builds a new Lsm directory at dstPath from a base backup made by
+// Backup and the archived log segments. Records are replayed up to and
+// including untilSeq and untilTimestamp, a zero value means no limit.
+// The file system and the key provider are taken from opts. The result is
+// opened with OpenLsm. ErrRestoreGap is returned if a segment holding writes
+// made after the backup is missing.
+func RestoreLsm(log log.LogInterface, backupPath string, archivePath string, dstPath string,
+	untilSeq uint64, untilTimestamp int64, opts *LsmOptions) error {
+	log.Pf(0, "restore %s -> %s", backupPath, dstPath)
+
+	fs := lsmFS(opts)
+	codec := opts.codec()
+	_, err := fs.Stat(dstPath)
+	if err == nil {
+		return ErrRestoreTargetExists
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	m, err := readManifest(fs, backupPath)
+	if err != nil {
+		return err
+	}
+
+	dirs := map[uint32]string{0: "."}
+	for _, record := range m.Families {
+		dirs[record.Id] = getFamilyPath(".", record.Id)
+	}
+
+	baseSeqs := make(map[uint32]uint64)
+	baseSeq := uint64(0)
+	for id, dir := range dirs {
+		maxSeq, err := restoreTables(fs, log, codec, filepath.Join(backupPath, dir), filepath.Join(dstPath, dir))
+		if err != nil {
+			return err
+		}
+		baseSeqs[id] = maxSeq
+		if maxSeq > baseSeq {
+			baseSeq = maxSeq
+		}
+	}
+
+	err = copyManifest(fs, backupPath, dstPath)
+	if err != nil {
+		return err
+	}
+
+	if untilSeq != 0 && baseSeq > untilSeq {
+		return fmt.Errorf("Backup is newer than sequence %d", untilSeq)
+	}
+
+	logFile, err := fs.OpenFile(filepath.Join(dstPath, logFileName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	w := &countingWriter{w: logFile}
+	c, err := writeFileHeader(w, codec.keys)
+	if err != nil {
+		return err
+	}
+
+	r := &restoreReplayer{fs: fs, codec: codec, logFile: w, logCipher: c, baseSeqs: baseSeqs,
+		baseSeq: baseSeq, untilSeq: untilSeq, untilTimestamp: untilTimestamp}
+
+	segmentIds, err := listFileIndexes(fs, archivePath, archiveFileNamePattern)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, id := range segmentIds {
+		if r.done {
+			break
+		}
+		err = r.replay(getArchiveSegmentPath(archivePath, id))
+		if err != nil {
+			log.Pf(0, "replay segment %d error %v", id, err)
+			return err
+		}
+	}
+
+	// The backup log may hold records which were never archived
+	if !r.done {
+		err = r.replay(filepath.Join(backupPath, logFileName))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	err = logFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	log.Pf(0, "restore %s -> %s done, base seq %d replayed %d last seq %d",
+		backupPath, dstPath, baseSeq, r.count, r.lastSeq)
+	return nil
+}
@@ -0,0 +1,170 @@
+package lsm
+
+import (
+	"sync/atomic"
+)
+
+type batchOp struct {
+	family  *ColumnFamily
+	key     string
+	value   string
+	deleted bool
+}
+
+// WriteBatch collects updates of one or more column families which
+// Lsm.Write applies atomically.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+func NewWriteBatch() *WriteBatch {
+	b := new(WriteBatch)
+	b.ops = make([]batchOp, 0)
+	return b
+}
+
+func (b *WriteBatch) Set(key string, value string) {
+	b.SetCF(nil, key, value)
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.DeleteCF(nil, key)
+}
+
+// SetCF adds a set of key in column family cf, nil means the default one.
+func (b *WriteBatch) SetCF(cf *ColumnFamily, key string, value string) {
+	b.ops = append(b.ops, batchOp{family: cf, key: key, value: value})
+}
+
+// DeleteCF adds a delete of key in column family cf, nil means the default
+// one.
+func (b *WriteBatch) DeleteCF(cf *ColumnFamily, key string) {
+	b.ops = append(b.ops, batchOp{family: cf, key: key, deleted: true})
+}
+
+func (b *WriteBatch) Count() int {
+	return len(b.ops)
+}
+
+// Write logs and applies every update of b. After a crash either all of
+// them are restored from the log or none.
+func (lsm *Lsm) Write(b *WriteBatch) error {
+	if lsm.readOnly {
+		return ErrReadOnly
+	}
+	if lsm.root != lsm {
+		return ErrColumnFamilyNotFound
+	}
+
+	limits := lsm.codec().limits
+	for _, op := range b.ops {
+		if op.key == "" {
+			return ErrEmptyKey
+		}
+		if !op.deleted && op.value == "" {
+			return ErrEmptyValue
+		}
+		err := limits.check(op.key, op.value)
+		if err != nil {
+			return err
+		}
+		if op.family != nil && op.family.lsm.root != lsm {
+			return ErrColumnFamilyNotFound
+		}
+	}
+
+	if len(b.ops) == 0 {
+		return nil
+	}
+
+	lsm.nodeMapLock.Lock()
+	defer lsm.nodeMapLock.Unlock()
+
+	err := lsm.stallWrite()
+	if err != nil {
+		return err
+	}
+
+	size := int64(0)
+	deletesOnly := true
+	for _, op := range b.ops {
+		size += recordSize(op.key, op.value)
+		deletesOnly = deletesOnly && op.deleted
+	}
+	err = lsm.checkWriteSpace(size, deletesOnly)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range b.ops {
+		if op.family != nil && op.family.lsm.dropped {
+			return ErrColumnFamilyNotFound
+		}
+	}
+
+	// A batch cut short by a write error is removed, otherwise the records
+	// which follow it would complete it on replay
+	logSize := lsm.logSize
+	seq := lsm.seq
+
+	nodes := make([]*LsmNode, len(b.ops))
+	for i, op := range b.ops {
+		n := newLsmNode(op.key, op.value)
+		n.deleted = op.deleted
+		if op.family != nil {
+			n.family = op.family.lsm.family.Id
+		}
+		n.batchLeft = uint32(len(b.ops) - 1 - i)
+		lsm.stampNode(n)
+
+		err := lsm.appendLog(n)
+		if err != nil {
+			if lsm.logSize != logSize {
+				lsm.logFile.Truncate(logSize)
+				lsm.logSize = logSize
+			}
+			lsm.seq = seq
+			return err
+		}
+		nodes[i] = n
+	}
+
+	if lsm.opts.Sync {
+		err := lsm.logFile.Sync()
+		if err != nil {
+			lsm.logFile.Truncate(logSize)
+			lsm.logSize = logSize
+			lsm.seq = seq
+			return err
+		}
+	}
+
+	for i, op := range b.ops {
+		n := nodes[i]
+		n.batchLeft = 0
+		lsm.publish(n)
+
+		family := lsm
+		if op.family != nil {
+			family = op.family.lsm
+			family.nodeMapLock.Lock()
+		}
+
+		family.putNode(family.nodeMap, n)
+		if n.deleted {
+			atomic.AddInt64(&family.counters.deletes, 1)
+		} else {
+			atomic.AddInt64(&family.counters.puts, 1)
+		}
+
+		if family != lsm {
+			family.nodeMapLock.Unlock()
+		}
+	}
+
+	err = lsm.compact()
+	if err != nil {
+		lsm.backgroundError("compact", err)
+	}
+	return nil
+}
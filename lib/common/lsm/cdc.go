@@ -0,0 +1,311 @@
+package lsm
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	ErrSequenceNotRetained = fmt.Errorf("Sequence is no longer retained")
+	ErrSubscriptionClosed  = fmt.Errorf("Subscription closed")
+)
+
+const (
+	// maxSubscriptionBacklog is how many events a subscription buffers
+	// before it falls back to reading the log
+	maxSubscriptionBacklog = 1024
+)
+
+type ChangeEvent struct {
+	Seq       uint64
+	Timestamp int64
+	// ColumnFamily is the id of the column family, zero for the default one
+	ColumnFamily uint32
+	Key          string
+	Value        string
+	Deleted      bool
+}
+
+func newChangeEvent(n *LsmNode) ChangeEvent {
+	return ChangeEvent{Seq: n.seq, Timestamp: n.timestamp, ColumnFamily: n.family,
+		Key: n.key, Value: n.value, Deleted: n.deleted}
+}
+
+// Subscription delivers committed mutations in sequence order. Events are
+// queued from the log write path, a subscriber which falls too far behind
+// reads them back from the log and the archived segments.
+type Subscription struct {
+	lsm     *Lsm
+	lock    sync.Mutex
+	cond    *sync.Cond
+	nextSeq uint64
+	queue   []ChangeEvent
+	lagging bool
+	closed  bool
+	err     error
+}
+
+// Subscribe returns a subscription to every mutation with a sequence of at
+// least fromSeq, zero means from the next write on. Older mutations are read
+// from the log, which holds what is not flushed yet, and from the archived
+// segments if ArchiveLog is set. ErrSequenceNotRetained is returned if
+// fromSeq is older than that.
+func (lsm *Lsm) Subscribe(fromSeq uint64) (*Subscription, error) {
+	lsm.nodeMapLock.Lock()
+	defer lsm.nodeMapLock.Unlock()
+
+	if fromSeq == 0 {
+		fromSeq = lsm.seq + 1
+	}
+
+	sub := &Subscription{lsm: lsm, nextSeq: fromSeq, queue: make([]ChangeEvent, 0)}
+	sub.cond = sync.NewCond(&sub.lock)
+	if fromSeq <= lsm.seq {
+		sources, err := lsm.retainedLogs(fromSeq)
+		if err != nil {
+			return nil, err
+		}
+		if len(sources) == 0 {
+			return nil, ErrSequenceNotRetained
+		}
+		sub.lagging = true
+	}
+
+	lsm.subscriptionsLock.Lock()
+	lsm.subscriptions[sub] = true
+	lsm.subscriptionsLock.Unlock()
+	return sub, nil
+}
+
+// publish queues n for every subscriber, must be called with nodeMapLock
+// held for writing after n is in the log.
+func (lsm *Lsm) publish(n *LsmNode) {
+	lsm.subscriptionsLock.Lock()
+	defer lsm.subscriptionsLock.Unlock()
+
+	for sub := range lsm.subscriptions {
+		sub.push(n)
+	}
+}
+
+func (lsm *Lsm) closeSubscriptions() {
+	lsm.subscriptionsLock.Lock()
+	subs := lsm.subscriptions
+	lsm.subscriptions = make(map[*Subscription]bool)
+	lsm.subscriptionsLock.Unlock()
+
+	for sub := range subs {
+		sub.fail(ErrSubscriptionClosed)
+	}
+}
+
+func readFirstSeq(lsm *Lsm, filePath string) (uint64, error) {
+	file, err := lsm.fs.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	nr, err := openNodeReader(file, filePath, lsm.codec())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := nr.next()
+	if err != nil {
+		return 0, err
+	}
+	return n.seq, nil
+}
+
+// retainedLogs returns the log files to read, oldest first, to find every
+// record from seq on. The result is empty if seq is not retained. Must be
+// called with nodeMapLock held.
+func (lsm *Lsm) retainedLogs(seq uint64) ([]string, error) {
+	paths := make([]string, 0)
+	if lsm.opts.ArchiveLog {
+		ids, err := listFileIndexes(lsm.fs, lsm.opts.ArchivePath, archiveFileNamePattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			paths = append(paths, getArchiveSegmentPath(lsm.opts.ArchivePath, id))
+		}
+	}
+	paths = append(paths, filepath.Join(lsm.rootPath, logFileName))
+
+	// Skip files which end before seq, the newest file starting at or
+	// before seq holds it
+	start := -1
+	for i, filePath := range paths {
+		firstSeq, err := readFirstSeq(lsm, filePath)
+		if err != nil {
+			if err == io.EOF {
+				continue
+			}
+			return nil, err
+		}
+		if firstSeq > seq {
+			break
+		}
+		start = i
+	}
+
+	if start < 0 {
+		return paths[:0], nil
+	}
+	return paths[start:], nil
+}
+
+// catchUp reads up to maxSubscriptionBacklog records from the log files
+// into the queue. Writers are held off meanwhile, so once the last record
+// is read the subscription can go on with queued events.
+func (sub *Subscription) catchUp() error {
+	lsm := sub.lsm
+	lsm.nodeMapLock.RLock()
+	defer lsm.nodeMapLock.RUnlock()
+
+	sub.lock.Lock()
+	nextSeq := sub.nextSeq
+	sub.lock.Unlock()
+
+	events := make([]ChangeEvent, 0)
+	if nextSeq <= lsm.seq {
+		paths, err := lsm.retainedLogs(nextSeq)
+		if err != nil {
+			return err
+		}
+		if len(paths) == 0 {
+			return ErrSequenceNotRetained
+		}
+
+		for _, filePath := range paths {
+			events, err = readChangeEvents(lsm, filePath, nextSeq, events)
+			if err != nil {
+				return err
+			}
+			if len(events) >= maxSubscriptionBacklog {
+				break
+			}
+		}
+	}
+
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	sub.queue = append(sub.queue, events...)
+	if len(events) < maxSubscriptionBacklog {
+		sub.lagging = false
+	}
+	return nil
+}
+
+func readChangeEvents(lsm *Lsm, filePath string, fromSeq uint64, events []ChangeEvent) ([]ChangeEvent, error) {
+	file, err := lsm.fs.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	nr, err := openNodeReader(file, filePath, lsm.codec())
+	if err != nil {
+		return nil, err
+	}
+
+	for len(events) < maxSubscriptionBacklog {
+		n, err := nr.next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if n.seq >= fromSeq {
+			events = append(events, newChangeEvent(n))
+		}
+	}
+	return events, nil
+}
+
+func (sub *Subscription) push(n *LsmNode) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	if sub.closed || sub.lagging {
+		return
+	}
+
+	if len(sub.queue) >= maxSubscriptionBacklog {
+		// Too slow, the rest is read back from the log
+		sub.queue = sub.queue[:0]
+		sub.lagging = true
+	} else {
+		sub.queue = append(sub.queue, newChangeEvent(n))
+	}
+	sub.cond.Signal()
+}
+
+func (sub *Subscription) fail(err error) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	if sub.err == nil {
+		sub.err = err
+	}
+	sub.closed = true
+	sub.cond.Broadcast()
+}
+
+// Next waits for the next event. It fails with ErrSequenceNotRetained if
+// the subscriber fell behind further than the log reaches and with
+// ErrSubscriptionClosed once the subscription or the Lsm is closed.
+func (sub *Subscription) Next() (*ChangeEvent, error) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	for {
+		if sub.closed {
+			return nil, sub.err
+		}
+
+		if len(sub.queue) > 0 {
+			ev := sub.queue[0]
+			sub.queue = sub.queue[1:]
+			if ev.Seq < sub.nextSeq {
+				continue
+			}
+			sub.nextSeq = ev.Seq + 1
+			return &ev, nil
+		}
+
+		if sub.lagging {
+			sub.lock.Unlock()
+			err := sub.catchUp()
+			sub.lock.Lock()
+			if err != nil {
+				sub.lock.Unlock()
+				sub.stop(err)
+				sub.lock.Lock()
+				return nil, err
+			}
+			continue
+		}
+
+		sub.cond.Wait()
+	}
+}
+
+func (sub *Subscription) stop(err error) {
+	sub.lsm.subscriptionsLock.Lock()
+	delete(sub.lsm.subscriptions, sub)
+	sub.lsm.subscriptionsLock.Unlock()
+
+	sub.fail(err)
+}
+
+// Close stops the subscription and wakes up a waiting Next.
+func (sub *Subscription) Close() {
+	sub.stop(ErrSubscriptionClosed)
+}
@@ -0,0 +1,345 @@
+package lsm
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/irqlevel/naiv/lib/common/vfs"
+)
+
+type tableIterator struct {
+	file   vfs.File
+	reader *nodeReader
+	node   *LsmNode
+	end    string
+}
+
+// newTableIterator walks the nodes of st with keys in [start, end), an
+// empty bound is open.
+func newTableIterator(st *SsTable, start string, end string) (*tableIterator, error) {
+	file, err := st.fs.OpenFile(st.filePath, os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := st.dataOffset
+	if start != "" && len(st.keys) > 0 {
+		keyIndex := sort.SearchStrings(st.keys, start)
+		if keyIndex > 0 {
+			keyIndex--
+		}
+		offset = st.keyToOffset[st.keys[keyIndex]]
+	}
+
+	it := &tableIterator{file: file, reader: st.newNodeReader(file, offset), end: end}
+	_, err = file.Seek(offset, os.SEEK_SET)
+	if err != nil {
+		it.close()
+		return nil, err
+	}
+
+	for {
+		err = it.next()
+		if err != nil {
+			it.close()
+			return nil, err
+		}
+		if it.node == nil || it.node.key >= start {
+			return it, nil
+		}
+	}
+}
+
+// next reads the following node, node is nil at the end of the table or
+// of the range
+func (it *tableIterator) next() error {
+	node, err := it.reader.next()
+	if err != nil {
+		it.node = nil
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	if it.end != "" && node.key >= it.end {
+		node = nil
+	}
+	it.node = node
+	return nil
+}
+
+func (it *tableIterator) close() {
+	it.file.Close()
+}
+
+// mergeTables writes the newest version of every key in [start, end) found
+// in tables, which are ordered newest first, into a new table at dstPath.
+// Older versions are kept as long as VersionRetention needs them.
+// Tombstones are dropped if dropDeleted is set. If nothing is left no file
+// is created and a nil table is returned. The output is encrypted with the
+// current master key, so CompactRange over every key moves all tables off
+// a rotated key.
+func (lsm *Lsm) mergeTables(tables []*SsTable, dstPath string, dropDeleted bool,
+	start string, end string) (*SsTable, error) {
+	its := make([]*tableIterator, 0, len(tables))
+	defer func() {
+		for _, it := range its {
+			it.close()
+		}
+	}()
+
+	for _, st := range tables {
+		st.lock.RLock()
+		defer st.lock.RUnlock()
+
+		it, err := newTableIterator(st, start, end)
+		if err != nil {
+			return nil, err
+		}
+		its = append(its, it)
+	}
+
+	dstFile, err := lsm.fs.OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &countingWriter{w: lsm.mergeThrottle().writer(dstFile)}
+	c, err := writeFileHeader(w, lsm.opts.KeyProvider)
+	if err != nil {
+		dstFile.Close()
+		lsm.fs.Remove(dstPath)
+		return nil, err
+	}
+
+	cutoff := lsm.versionCutoff()
+	count := int64(0)
+	versions := make([]*LsmNode, 0)
+	for {
+		var newNode *LsmNode
+		for _, it := range its {
+			if it.node != nil && (newNode == nil || it.node.key < newNode.key) {
+				newNode = it.node
+			}
+		}
+
+		if newNode == nil {
+			break
+		}
+
+		// Gather the versions of the key newest first, the tables are
+		// ordered so and so are the versions within a table. A record
+		// stored in two tables is kept once, an older table can only add
+		// versions older than those gathered.
+		key := newNode.key
+		versions = versions[:0]
+		for _, it := range its {
+			for it.node != nil && it.node.key == key {
+				if len(versions) == 0 || it.node.seq < versions[len(versions)-1].seq {
+					versions = append(versions, it.node)
+				}
+				err = it.next()
+				if err != nil {
+					dstFile.Close()
+					lsm.fs.Remove(dstPath)
+					return nil, err
+				}
+			}
+		}
+
+		versions = versions[:retainedVersions(versions, cutoff)]
+		if dropDeleted {
+			// Nothing older is left to shadow, so a tombstone reads the
+			// same as no version at all
+			for len(versions) > 0 && versions[len(versions)-1].deleted {
+				versions = versions[:len(versions)-1]
+			}
+		}
+
+		for _, node := range versions {
+			err = node.writeTo(w, c, w.n)
+			if err != nil {
+				dstFile.Close()
+				lsm.fs.Remove(dstPath)
+				return nil, err
+			}
+			count++
+		}
+	}
+
+	if count != 0 {
+		err = dstFile.Sync()
+		if err != nil {
+			dstFile.Close()
+			lsm.fs.Remove(dstPath)
+			return nil, err
+		}
+	}
+
+	dstFile.Close()
+	if count == 0 {
+		lsm.fs.Remove(dstPath)
+		return nil, nil
+	}
+
+	st, err := openSsTable(lsm.fs, lsm.log, dstPath, lsm.codec())
+	if err != nil {
+		lsm.fs.Remove(dstPath)
+		return nil, err
+	}
+	return st, nil
+}
+
+func tableOverlaps(st *SsTable, start string, end string) bool {
+	if st.minKey == nil {
+		return false
+	}
+	if end != "" && *st.minKey >= end {
+		return false
+	}
+	if start != "" && *st.maxKey < start {
+		return false
+	}
+	return true
+}
+
+// Flush writes the memory nodes into a new table.
+func (lsm *Lsm) Flush() error {
+	if lsm.readOnly {
+		return ErrReadOnly
+	}
+
+	lsm.nodeMapLock.Lock()
+	defer lsm.nodeMapLock.Unlock()
+
+	lsm.log.Pf(0, "flush size %d", len(lsm.nodeMap))
+	return lsm.flush()
+}
+
+// CompactRange merges every table holding keys in [start, end) into one
+// table without tombstones and shadowed versions, or into one per key range
+// with MaxSubcompactions. An empty start or end means the range is not
+// bounded on that side. The memory nodes are flushed first. The input set
+// is widened until no other table overlaps it, so the output holds the only
+// copy of its keys and tombstones can be dropped.
+func (lsm *Lsm) CompactRange(start string, end string) error {
+	if lsm.readOnly {
+		return ErrReadOnly
+	}
+
+	lsm.nodeMapLock.Lock()
+	defer lsm.nodeMapLock.Unlock()
+
+	lsm.log.Pf(0, "compact range [%s, %s)", start, end)
+	begin := time.Now()
+
+	err := lsm.flush()
+	if err != nil {
+		return err
+	}
+
+	lsm.mergeLock.Lock()
+	defer lsm.mergeLock.Unlock()
+	lsm.ssTableMapLock.Lock()
+	defer lsm.ssTableMapLock.Unlock()
+
+	inputs := make(map[int64]bool)
+	for {
+		added := false
+		for id, st := range lsm.ssTableMap {
+			if inputs[id] || !tableOverlaps(st, start, end) {
+				continue
+			}
+			inputs[id] = true
+			added = true
+		}
+
+		if !added {
+			break
+		}
+
+		// Widen the range to cover every input table
+		for id := range inputs {
+			st := lsm.ssTableMap[id]
+			if start != "" && *st.minKey < start {
+				start = *st.minKey
+			}
+			if end != "" && *st.maxKey >= end {
+				end = *st.maxKey + "\x00"
+			}
+		}
+	}
+
+	if len(inputs) == 0 {
+		lsm.log.Pf(0, "compact range nothing to do")
+		return nil
+	}
+
+	ids := make([]int64, 0, len(inputs))
+	for id := range inputs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+
+	tables := make([]*SsTable, len(ids))
+	for i, id := range ids {
+		tables[i] = lsm.ssTableMap[id]
+		lsm.log.Pf(0, "compact range input %d", id)
+	}
+
+	info := CompactionInfo{Inputs: ids, Outputs: []int64{}, DropDeleted: true}
+	lsm.opts.EventListener.OnCompactionBegin(info)
+	size := int64(0)
+	for _, st := range tables {
+		size += st.size
+	}
+
+	// Every table holding the keys is an input, so the outputs can take
+	// the newest ids
+	var outIds []int64
+	err = lsm.checkFreeSpace(size)
+	if err == nil {
+		outIds, err = lsm.subcompact(tables, lsm.subcompactionBounds(tables, size), size, true)
+		err = lsm.spaceError(err)
+	}
+	if err != nil {
+		lsm.log.Pf(0, "compact range error %v", err)
+		info.Duration = sinceDuration(begin)
+		lsm.opts.EventListener.OnCompactionCompleted(info)
+		return err
+	}
+
+	// Oldest first, the outputs have no tombstones and an input left by
+	// a crash must not be older than what it hides
+	dirs := make(map[string]bool)
+	for i := len(ids) - 1; i >= 0; i-- {
+		dirs[filepath.Dir(tables[i].filePath)] = true
+		delete(lsm.ssTableMap, ids[i])
+		tables[i].Erase()
+	}
+	for dir := range dirs {
+		err = lsm.fs.SyncDir(dir)
+		if err != nil {
+			lsm.log.Pf(0, "sync dir %s error %v", dir, err)
+		}
+	}
+
+	info.Outputs = append(info.Outputs, outIds...)
+	atomic.AddInt64(&lsm.counters.merges, 1)
+	lsm.counters.mergeDuration.Append(sinceUs(begin))
+	info.Duration = sinceDuration(begin)
+	lsm.opts.EventListener.OnCompactionCompleted(info)
+
+	err = lsm.placeSsTables()
+	if err != nil {
+		lsm.backgroundError("place tables", err)
+	}
+
+	lsm.log.Pf(0, "compact range [%s, %s) done, %d tables -> %v in %v",
+		start, end, len(ids), outIds, time.Since(begin))
+	return nil
+}
@@ -0,0 +1,316 @@
+package lsm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/irqlevel/naiv/lib/common/vfs"
+)
+
+var (
+	ErrNoKeyProvider      = fmt.Errorf("File is encrypted and no key provider is set")
+	ErrKeyNotFound        = fmt.Errorf("Encryption key not found")
+	ErrBadFileHeader      = fmt.Errorf("Bad encrypted file header")
+	ErrLsmNodeBadSeal     = fmt.Errorf("Lsm node can't be decrypted")
+	ErrLsmNodeNotSealed   = fmt.Errorf("Lsm node is not encrypted in an encrypted file")
+	ErrBadEncryptionKeyId = fmt.Errorf("Bad encryption key id")
+)
+
+const (
+	fileHeaderMagic     = uint32(0x4CBDF11E)
+	sealedNodeMagic     = uint32(0x4CBD5EA1)
+	dataKeySize         = 32
+	maxKeyIdLength      = 256
+	gcmNonceSize        = 12
+	sealedNodeFrameSize = 8 + gcmNonceSize
+)
+
+// KeyProvider supplies the master keys which wrap the data key of every
+// encrypted file. A master key is 16, 24 or 32 bytes long for AES-128,
+// AES-192 or AES-256.
+type KeyProvider interface {
+	// CurrentKey returns the id and the key new files are encrypted with
+	CurrentKey() (string, []byte, error)
+	// Key returns the key with the given id, older files may refer to a key
+	// which is no longer the current one
+	Key(id string) ([]byte, error)
+}
+
+// FileKeyProvider reads master keys from a directory with one hex encoded
+// key per file named by the key id. The greatest id is the current key, so
+// a key is rotated by adding a file with a greater name.
+type FileKeyProvider struct {
+	dirPath string
+}
+
+func NewFileKeyProvider(dirPath string) *FileKeyProvider {
+	return &FileKeyProvider{dirPath: dirPath}
+}
+
+func (p *FileKeyProvider) CurrentKey() (string, []byte, error) {
+	files, err := ioutil.ReadDir(p.dirPath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ids := make([]string, 0)
+	for _, file := range files {
+		if !file.IsDir() {
+			ids = append(ids, file.Name())
+		}
+	}
+	if len(ids) == 0 {
+		return "", nil, ErrKeyNotFound
+	}
+	sort.Strings(ids)
+
+	id := ids[len(ids)-1]
+	key, err := p.Key(id)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, key, nil
+}
+
+func (p *FileKeyProvider) Key(id string) ([]byte, error) {
+	if id == "" || id != filepath.Base(id) {
+		return nil, ErrBadEncryptionKeyId
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(p.dirPath, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrKeyNotFound
+		}
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(data)))
+}
+
+// fileCipher seals the nodes of one file with its data key.
+type fileCipher struct {
+	keyId string
+	aead  cipher.AEAD
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newFileCipher makes a random data key and returns a cipher for it with
+// the file header holding the data key wrapped by the current master key.
+//
+// File header layout, one block:
+// magic | key id length (2) | wrapped key length (2) | key id | nonce | wrapped key
+func newFileCipher(keys KeyProvider) (*fileCipher, []byte, error) {
+	keyId, masterKey, err := keys.CurrentKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	if keyId == "" || len(keyId) > maxKeyIdLength {
+		return nil, nil, ErrBadEncryptionKeyId
+	}
+
+	master, err := newGCM(masterKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	_, err = io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := getAlignedBlock(IoBlockSize, IoBlockSize)
+	binary.LittleEndian.PutUint32(header[0:], fileHeaderMagic)
+	binary.LittleEndian.PutUint16(header[4:], uint16(len(keyId)))
+	binary.LittleEndian.PutUint16(header[6:], uint16(dataKeySize+master.Overhead()))
+	copy(header[8:], keyId)
+
+	nonce := header[8+len(keyId) : 8+len(keyId)+gcmNonceSize]
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	master.Seal(header[8+len(keyId)+gcmNonceSize:8+len(keyId)+gcmNonceSize], nonce, dataKey,
+		header[0:8+len(keyId)])
+
+	return &fileCipher{keyId: keyId, aead: aead}, header, nil
+}
+
+// writeFileHeader starts the empty file w with a new data key. Nothing is
+// written and the cipher is nil if keys is nil.
+func writeFileHeader(w io.Writer, keys KeyProvider) (*fileCipher, error) {
+	if keys == nil {
+		return nil, nil
+	}
+
+	c, header, err := newFileCipher(keys)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readFileHeader returns the cipher of file r and the offset its nodes
+// start at. A file without the header is plain text, nil and zero are
+// returned for it.
+func readFileHeader(r io.ReaderAt, keys KeyProvider) (*fileCipher, int64, error) {
+	header := getAlignedBlock(IoBlockSize, IoBlockSize)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	if n < 4 || binary.LittleEndian.Uint32(header[0:]) != fileHeaderMagic {
+		return nil, 0, nil
+	}
+	if n < IoBlockSize {
+		return nil, 0, ErrBadFileHeader
+	}
+	if keys == nil {
+		return nil, 0, ErrNoKeyProvider
+	}
+
+	idLength := int(binary.LittleEndian.Uint16(header[4:]))
+	wrappedLength := int(binary.LittleEndian.Uint16(header[6:]))
+	if idLength > maxKeyIdLength || 8+idLength+gcmNonceSize+wrappedLength > IoBlockSize {
+		return nil, 0, ErrBadFileHeader
+	}
+
+	keyId := string(header[8 : 8+idLength])
+	masterKey, err := keys.Key(keyId)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	master, err := newGCM(masterKey)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	nonce := header[8+idLength : 8+idLength+gcmNonceSize]
+	wrapped := header[8+idLength+gcmNonceSize : 8+idLength+gcmNonceSize+wrappedLength]
+	dataKey, err := master.Open(nil, nonce, wrapped, header[0:8+idLength])
+	if err != nil {
+		return nil, 0, ErrBadFileHeader
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &fileCipher{keyId: keyId, aead: aead}, IoBlockSize, nil
+}
+
+// openNodeReader reads the header of file and returns a reader of its
+// nodes from the first one on.
+func openNodeReader(file vfs.File, filePath string, codec nodeCodec) (*nodeReader, error) {
+	c, offset, err := readFileHeader(file, codec.keys)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return &nodeReader{r: file, filePath: filePath, offset: offset, cipher: c, limits: codec.limits}, nil
+}
+
+// seal encrypts node into a frame of whole blocks for the file offset. The
+// header, key and value are sealed together, the frame header and the
+// offset are authenticated, so a frame can't be moved within the file.
+//
+// Frame layout: magic | sealed length (4) | nonce | sealed node
+func (c *fileCipher) seal(node *LsmNode, offset int64) ([]byte, error) {
+	plain := make([]byte, 0, lsmNodeHeaderSize+len(node.key)+len(node.value))
+	plain = append(plain, node.header()...)
+	plain = append(plain, node.key...)
+	plain = append(plain, node.value...)
+
+	sealedLength := len(plain) + c.aead.Overhead()
+	frame := getAlignedBlockByLen(sealedNodeFrameSize+sealedLength, IoBlockSize)
+	binary.LittleEndian.PutUint32(frame[0:], sealedNodeMagic)
+	binary.LittleEndian.PutUint32(frame[4:], uint32(sealedLength))
+
+	nonce := frame[8:sealedNodeFrameSize]
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	c.aead.Seal(frame[sealedNodeFrameSize:sealedNodeFrameSize], nonce, plain, frameData(frame, offset))
+	return frame, nil
+}
+
+// frameData is the additional data of a frame at offset.
+func frameData(frame []byte, offset int64) []byte {
+	data := make([]byte, 16)
+	copy(data, frame[0:8])
+	binary.LittleEndian.PutUint64(data[8:], uint64(offset))
+	return data
+}
+
+// readSealed reads the rest of the frame at offset starting with block and
+// decrypts the node from it.
+func (node *LsmNode) readSealed(f io.Reader, block []byte, c *fileCipher, offset int64,
+	limits sizeLimits) (int64, error) {
+	sealedLength := int64(binary.LittleEndian.Uint32(block[4:]))
+	if sealedLength > int64(lsmNodeHeaderSize+limits.maxKeySize+limits.maxValueSize+c.aead.Overhead()) {
+		return 0, ErrLsmNodeTooLarge
+	}
+
+	frame := getAlignedBlockByLen(sealedNodeFrameSize+int(sealedLength), IoBlockSize)
+	copy(frame, block)
+	if len(frame) > len(block) {
+		err := readFull(f, frame[len(block):])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	plain, err := c.aead.Open(nil, frame[8:sealedNodeFrameSize],
+		frame[sealedNodeFrameSize:sealedNodeFrameSize+int(sealedLength)], frameData(frame, offset))
+	if err != nil || len(plain) < lsmNodeHeaderSize ||
+		binary.LittleEndian.Uint32(plain[0:]) != LsmNodeMagic {
+		return 0, ErrLsmNodeBadSeal
+	}
+
+	keyLength := int64(binary.LittleEndian.Uint32(plain[8:]))
+	valueLength := int64(binary.LittleEndian.Uint32(plain[12:]))
+	if keyLength > int64(limits.maxKeySize) || valueLength > int64(limits.maxValueSize) {
+		return 0, ErrLsmNodeTooLarge
+	}
+	if lsmNodeHeaderSize+keyLength+valueLength != int64(len(plain)) {
+		return 0, ErrLsmNodeBadSeal
+	}
+
+	err = node.decode(plain[0:lsmNodeHeaderSize], plain[lsmNodeHeaderSize:lsmNodeHeaderSize+keyLength],
+		plain[lsmNodeHeaderSize+keyLength:])
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(frame)), nil
+}
@@ -0,0 +1,109 @@
+package lsm
+
+import (
+	"sort"
+)
+
+func keyInRange(key string, start string, end string) bool {
+	return (start == "" || key >= start) && (end == "" || key < end)
+}
+
+// position estimates the number of nodes and bytes of st before key from
+// the sparse index. Inside an index block the middle of the block is taken.
+// Must be called with st.lock held.
+func (st *SsTable) position(key string) (int64, int64) {
+	if st.minKey == nil || key <= *st.minKey {
+		return 0, 0
+	}
+	if key > *st.maxKey {
+		return st.count, st.size
+	}
+
+	i := sort.SearchStrings(st.keys, key) - 1
+	if i < 0 {
+		return 0, 0
+	}
+
+	blockStart, blockEnd := st.keyToOffset[st.keys[i]], st.size
+	countStart, countEnd := st.keyToCount[st.keys[i]], st.count
+	if i+1 < len(st.keys) {
+		blockEnd = st.keyToOffset[st.keys[i+1]]
+		countEnd = st.keyToCount[st.keys[i+1]]
+	}
+
+	return (countStart + countEnd) / 2, (blockStart + blockEnd) / 2
+}
+
+// estimate returns the approximate number of nodes and bytes of st with a
+// key in [start, end).
+func (st *SsTable) estimate(start string, end string) (int64, int64) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	if !tableOverlaps(st, start, end) {
+		return 0, 0
+	}
+
+	startCount, startSize := int64(0), int64(0)
+	if start != "" {
+		startCount, startSize = st.position(start)
+	}
+
+	endCount, endSize := st.count, st.size
+	if end != "" {
+		endCount, endSize = st.position(end)
+	}
+
+	if endCount < startCount || endSize < startSize {
+		return 0, 0
+	}
+	return endCount - startCount, endSize - startSize
+}
+
+// approximate sums the estimates of the memory nodes and every table for
+// keys in [start, end), an empty bound is open. Versions of a key in
+// several places are all counted.
+func (lsm *Lsm) approximate(start string, end string) (int64, int64) {
+	lsm.nodeMapLock.RLock()
+	defer lsm.nodeMapLock.RUnlock()
+
+	count, size := int64(0), int64(0)
+	for key, node := range lsm.nodeMap {
+		if keyInRange(key, start, end) {
+			count++
+			size += node.diskSize()
+		}
+	}
+
+	lsm.ssTableMapLock.RLock()
+	defer lsm.ssTableMapLock.RUnlock()
+
+	for _, st := range lsm.ssTableMap {
+		stCount, stSize := st.estimate(start, end)
+		count += stCount
+		size += stSize
+	}
+	return count, size
+}
+
+// ApproximateSize estimates the bytes taken by keys in [start, end) from
+// the table indexes and the memory nodes without reading any data.
+func (lsm *Lsm) ApproximateSize(start string, end string) int64 {
+	_, size := lsm.approximate(start, end)
+	return size
+}
+
+// ApproximateCount estimates the number of keys in [start, end) like
+// ApproximateSize. Deleted keys and overwritten versions are included.
+func (lsm *Lsm) ApproximateCount(start string, end string) int64 {
+	count, _ := lsm.approximate(start, end)
+	return count
+}
+
+func (cf *ColumnFamily) ApproximateSize(start string, end string) int64 {
+	return cf.lsm.ApproximateSize(start, end)
+}
+
+func (cf *ColumnFamily) ApproximateCount(start string, end string) int64 {
+	return cf.lsm.ApproximateCount(start, end)
+}
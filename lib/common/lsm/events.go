@@ -0,0 +1,63 @@
+package lsm
+
+import (
+	"time"
+)
+
+type FlushInfo struct {
+	TableId  int64
+	Count    int
+	Size     int64
+	Duration time.Duration
+}
+
+type CompactionInfo struct {
+	Inputs      []int64
+	Outputs     []int64
+	DropDeleted bool
+	Duration    time.Duration
+}
+
+type TableInfo struct {
+	TableId  int64
+	FilePath string
+}
+
+// EventListener is notified about flushes, compactions and table removal.
+// Every begin event is followed by a completed one, also when the work
+// fails. Callbacks run synchronously with engine locks held, so they must
+// be quick and must not call back into the Lsm.
+type EventListener interface {
+	OnFlushBegin(info FlushInfo)
+	OnFlushCompleted(info FlushInfo)
+	OnCompactionBegin(info CompactionInfo)
+	OnCompactionCompleted(info CompactionInfo)
+	OnTableDeleted(info TableInfo)
+	OnBackgroundError(err error)
+}
+
+// NopEventListener ignores every event, embed it to implement only a few
+// callbacks.
+type NopEventListener struct{}
+
+func (NopEventListener) OnFlushBegin(info FlushInfo)               {}
+func (NopEventListener) OnFlushCompleted(info FlushInfo)           {}
+func (NopEventListener) OnCompactionBegin(info CompactionInfo)     {}
+func (NopEventListener) OnCompactionCompleted(info CompactionInfo) {}
+func (NopEventListener) OnTableDeleted(info TableInfo)             {}
+func (NopEventListener) OnBackgroundError(err error)               {}
+
+// addSsTable puts st into the table map, must be called with
+// ssTableMapLock held for writing.
+func (lsm *Lsm) addSsTable(id int64, st *SsTable) {
+	listener := lsm.opts.EventListener
+	st.onErase = func(filePath string) {
+		listener.OnTableDeleted(TableInfo{TableId: id, FilePath: filePath})
+	}
+	lsm.ssTableMap[id] = st
+}
+
+func (lsm *Lsm) backgroundError(op string, err error) {
+	lsm.log.Pf(0, "%s error %v", op, err)
+	lsm.opts.EventListener.OnBackgroundError(err)
+}
@@ -0,0 +1,396 @@
+package lsm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/irqlevel/naiv/lib/common/vfs"
+)
+
+var (
+	ErrColumnFamilyExists   = fmt.Errorf("Column family already exists")
+	ErrColumnFamilyNotFound = fmt.Errorf("Column family not found")
+)
+
+const (
+	manifestFileName = "MANIFEST"
+	familyDirPrefix  = "cf_"
+)
+
+type columnFamilyRecord struct {
+	Id   uint32
+	Name string
+}
+
+// familyManifest lists the column families other than the default one.
+// Family ids are never reused, so log records of a dropped family can't be
+// taken for records of a new one.
+type familyManifest struct {
+	NextId   uint32
+	Families []columnFamilyRecord
+}
+
+func newFamilyManifest() *familyManifest {
+	return &familyManifest{NextId: 1, Families: make([]columnFamilyRecord, 0)}
+}
+
+func readManifest(fs vfs.FS, rootPath string) (*familyManifest, error) {
+	file, err := fs.Open(filepath.Join(rootPath, manifestFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return newFamilyManifest(), nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	m := newFamilyManifest()
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeManifest replaces the manifest file through a synced temporary file,
+// so a crash leaves either the old or the new one.
+func writeManifest(fs vfs.FS, rootPath string, m *familyManifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	filePath := filepath.Join(rootPath, manifestFileName)
+	tmpFilePath := filePath + ".tmp"
+	file, err := fs.OpenFile(tmpFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		fs.Remove(tmpFilePath)
+		return err
+	}
+
+	err = fs.Rename(tmpFilePath, filePath)
+	if err != nil {
+		fs.Remove(tmpFilePath)
+		return err
+	}
+	return fs.SyncDir(rootPath)
+}
+
+func getFamilyPath(rootPath string, id uint32) string {
+	return filepath.Join(rootPath, familyDirPrefix+strconv.FormatUint(uint64(id), 10))
+}
+
+// listTableDirs returns rootPath and the directories of its column
+// families, relative to rootPath.
+func listTableDirs(fs vfs.FS, rootPath string) ([]string, error) {
+	m, err := readManifest(fs, rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := []string{"."}
+	for _, record := range m.Families {
+		dirs = append(dirs, getFamilyPath(".", record.Id))
+	}
+	return dirs, nil
+}
+
+// copyManifest copies the manifest of srcPath into dstPath if there is one.
+func copyManifest(fs vfs.FS, srcPath string, dstPath string) error {
+	err := copyFile(fs, filepath.Join(srcPath, manifestFileName), filepath.Join(dstPath, manifestFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ColumnFamily is a separate key space of an Lsm with its own memory nodes,
+// tables and options. All families share the log of the Lsm, so a
+// WriteBatch spanning several of them is atomic.
+type ColumnFamily struct {
+	lsm *Lsm
+}
+
+func (lsm *Lsm) familyOptions(name string, opts *LsmOptions) *LsmOptions {
+	if opts == nil {
+		opts = lsm.opts.ColumnFamilyOptions[name]
+	}
+	if opts == nil {
+		opts = DefaultLsmOptions()
+	}
+
+	familyOpts := *opts
+	familyOpts.FS = lsm.fs
+	familyOpts.ArchiveLog = false
+	familyOpts.ColumnFamilyOptions = nil
+	familyOpts.KeyProvider = lsm.opts.KeyProvider
+	familyOpts.MaxKeySize = lsm.opts.MaxKeySize
+	familyOpts.MaxValueSize = lsm.opts.MaxValueSize
+	return &familyOpts
+}
+
+func (lsm *Lsm) newFamily(record columnFamilyRecord, opts *LsmOptions) *Lsm {
+	family := newLsm(lsm.log, getFamilyPath(lsm.rootPath, record.Id), nil, opts)
+	family.root = lsm
+	family.family = &record
+
+	// Each data path gets a directory for the family like the root path
+	family.opts.DataPaths = nil
+	for _, p := range lsm.opts.DataPaths {
+		family.opts.DataPaths = append(family.opts.DataPaths,
+			DataPath{Path: getFamilyPath(p.Path, record.Id), TargetSize: p.TargetSize})
+	}
+	return family
+}
+
+// openFamilies opens the tables of every column family in the manifest.
+func (lsm *Lsm) openFamilies() error {
+	m, err := readManifest(lsm.fs, lsm.rootPath)
+	if err != nil {
+		return err
+	}
+	lsm.manifest = m
+
+	for _, record := range m.Families {
+		family := lsm.newFamily(record, lsm.familyOptions(record.Name, nil))
+		err = family.openSsTables()
+		if err != nil {
+			family.closeFamily()
+			return err
+		}
+		lsm.families[record.Id] = family
+		if family.seq > lsm.seq {
+			lsm.seq = family.seq
+		}
+	}
+	return nil
+}
+
+func (lsm *Lsm) closeFamily() {
+	lsm.mergeTimer.Stop()
+	lsm.compactTimer.Stop()
+	lsm.closeSsTables()
+}
+
+func (lsm *Lsm) closeFamilies() {
+	for _, family := range lsm.families {
+		family.nodeMapLock.Lock()
+		family.closeFamily()
+		family.nodeMapLock.Unlock()
+	}
+}
+
+func (lsm *Lsm) findFamily(name string) *Lsm {
+	for _, family := range lsm.families {
+		if family.family.Name == name {
+			return family
+		}
+	}
+	return nil
+}
+
+// CreateColumnFamily adds a column family, opts nil means the options in
+// LsmOptions.ColumnFamilyOptions or the default ones. The file system, the
+// log, the encryption and the size limits are always those of the Lsm, the
+// family keeps its tables in a directory of each of the Lsm data paths.
+func (lsm *Lsm) CreateColumnFamily(name string, opts *LsmOptions) (*ColumnFamily, error) {
+	if lsm.readOnly {
+		return nil, ErrReadOnly
+	}
+	if lsm.root != lsm {
+		return nil, ErrColumnFamilyNotFound
+	}
+	if name == "" {
+		return nil, ErrEmptyKey
+	}
+
+	lsm.nodeMapLock.Lock()
+	defer lsm.nodeMapLock.Unlock()
+
+	if lsm.findFamily(name) != nil {
+		return nil, ErrColumnFamilyExists
+	}
+
+	record := columnFamilyRecord{Id: lsm.manifest.NextId, Name: name}
+	family := lsm.newFamily(record, lsm.familyOptions(name, opts))
+	err := lsm.fs.MkdirAll(family.rootPath, 0700)
+	if err == nil {
+		err = family.makeDataPaths()
+	}
+	if err != nil {
+		family.closeFamily()
+		return nil, err
+	}
+
+	m := &familyManifest{NextId: record.Id + 1,
+		Families: append(append([]columnFamilyRecord{}, lsm.manifest.Families...), record)}
+	err = writeManifest(lsm.fs, lsm.rootPath, m)
+	if err != nil {
+		family.closeFamily()
+		return nil, err
+	}
+
+	lsm.manifest = m
+	lsm.families[record.Id] = family
+	lsm.log.Pf(0, "created column family %s id %d", name, record.Id)
+	return &ColumnFamily{lsm: family}, nil
+}
+
+// ColumnFamily looks up the column family called name.
+func (lsm *Lsm) ColumnFamily(name string) (*ColumnFamily, error) {
+	lsm.nodeMapLock.RLock()
+	defer lsm.nodeMapLock.RUnlock()
+
+	family := lsm.findFamily(name)
+	if family == nil {
+		return nil, ErrColumnFamilyNotFound
+	}
+	return &ColumnFamily{lsm: family}, nil
+}
+
+// ColumnFamilies returns the names of the column families, the default one
+// is not included.
+func (lsm *Lsm) ColumnFamilies() []string {
+	lsm.nodeMapLock.RLock()
+	defer lsm.nodeMapLock.RUnlock()
+
+	names := make([]string, 0, len(lsm.families))
+	for _, family := range lsm.families {
+		names = append(names, family.family.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DropColumnFamily removes the column family name and all its data. Its
+// records left in the log are skipped from now on.
+func (lsm *Lsm) DropColumnFamily(name string) error {
+	if lsm.readOnly {
+		return ErrReadOnly
+	}
+
+	lsm.nodeMapLock.Lock()
+	defer lsm.nodeMapLock.Unlock()
+
+	family := lsm.findFamily(name)
+	if family == nil {
+		return ErrColumnFamilyNotFound
+	}
+
+	m := &familyManifest{NextId: lsm.manifest.NextId, Families: make([]columnFamilyRecord, 0)}
+	for _, record := range lsm.manifest.Families {
+		if record.Id != family.family.Id {
+			m.Families = append(m.Families, record)
+		}
+	}
+	err := writeManifest(lsm.fs, lsm.rootPath, m)
+	if err != nil {
+		return err
+	}
+	lsm.manifest = m
+	delete(lsm.families, family.family.Id)
+
+	family.nodeMapLock.Lock()
+	defer family.nodeMapLock.Unlock()
+	family.mergeLock.Lock()
+	defer family.mergeLock.Unlock()
+
+	family.ssTableMapLock.Lock()
+	for id, st := range family.ssTableMap {
+		st.Erase()
+		delete(family.ssTableMap, id)
+	}
+	family.ssTableMapLock.Unlock()
+
+	family.mergeTimer.Stop()
+	family.compactTimer.Stop()
+	family.nodeMap = make(map[string]*LsmNode)
+	family.dropped = true
+
+	err = lsm.fs.Remove(family.rootPath)
+	if err != nil && !os.IsNotExist(err) {
+		lsm.log.Pf(0, "remove %s error %v", family.rootPath, err)
+	}
+	family.removeDataPaths()
+	lsm.log.Pf(0, "dropped column family %s id %d", name, family.family.Id)
+	return nil
+}
+
+// dropped tells whether the family was dropped, DropColumnFamily sets it
+// with the family nodeMapLock held.
+func (cf *ColumnFamily) dropped() bool {
+	cf.lsm.nodeMapLock.RLock()
+	defer cf.lsm.nodeMapLock.RUnlock()
+	return cf.lsm.dropped
+}
+
+func (cf *ColumnFamily) Name() string {
+	return cf.lsm.family.Name
+}
+
+// Id identifies the family in ChangeEvent.
+func (cf *ColumnFamily) Id() uint32 {
+	return cf.lsm.family.Id
+}
+
+func (cf *ColumnFamily) Set(key string, value string) error {
+	b := NewWriteBatch()
+	b.SetCF(cf, key, value)
+	return cf.lsm.root.Write(b)
+}
+
+func (cf *ColumnFamily) Delete(key string) error {
+	b := NewWriteBatch()
+	b.DeleteCF(cf, key)
+	return cf.lsm.root.Write(b)
+}
+
+func (cf *ColumnFamily) Get(key string) (string, error) {
+	if cf.dropped() {
+		return "", ErrColumnFamilyNotFound
+	}
+	return cf.lsm.Get(key)
+}
+
+// Flush writes the memory nodes of the family into a table. They stay in
+// the log until the default family is flushed.
+func (cf *ColumnFamily) Flush() error {
+	root := cf.lsm.root
+	if root.readOnly {
+		return ErrReadOnly
+	}
+
+	root.nodeMapLock.Lock()
+	defer root.nodeMapLock.Unlock()
+
+	if cf.lsm.dropped {
+		return ErrColumnFamilyNotFound
+	}
+
+	cf.lsm.nodeMapLock.Lock()
+	defer cf.lsm.nodeMapLock.Unlock()
+	return cf.lsm.flush()
+}
+
+func (cf *ColumnFamily) Stats() *LsmStats {
+	return cf.lsm.Stats()
+}
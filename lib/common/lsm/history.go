@@ -0,0 +1,118 @@
+package lsm
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+
+	"github.com/irqlevel/naiv/lib/common/timestamp"
+)
+
+var (
+	ErrTimestampNotRetained = fmt.Errorf("Timestamp is older than the version retention")
+)
+
+// versionCutoff returns the time before which replaced versions may be
+// dropped, a version is kept while the one which replaced it was written
+// after the cutoff. Without VersionRetention only the newest one is kept.
+func (lsm *Lsm) versionCutoff() int64 {
+	if lsm.opts.VersionRetention <= 0 {
+		return math.MaxInt64
+	}
+	return timestamp.GetTimestamp() - int64(lsm.opts.VersionRetention)
+}
+
+// putNode makes n the newest version of its key in nodeMap. The versions it
+// replaces are chained to it as long as they are retained.
+func (lsm *Lsm) putNode(nodeMap map[string]*LsmNode, n *LsmNode) {
+	cutoff := lsm.versionCutoff()
+	if cutoff != math.MaxInt64 {
+		n.older = nodeMap[n.key]
+		for v := n; v.older != nil; v = v.older {
+			if v.timestamp <= cutoff {
+				v.older = nil
+				break
+			}
+		}
+	}
+	nodeMap[n.key] = n
+}
+
+// versionAt returns the newest of the chained versions starting at n which
+// was written at or before ts, nil if there is none.
+func versionAt(n *LsmNode, ts int64) *LsmNode {
+	for v := n; v != nil; v = v.older {
+		if v.timestamp <= ts {
+			return v
+		}
+	}
+	return nil
+}
+
+// retainedVersions returns how many of the versions of one key, newest
+// first, are still needed for reads after cutoff.
+func retainedVersions(versions []*LsmNode, cutoff int64) int {
+	n := 1
+	for n < len(versions) && versions[n-1].timestamp > cutoff {
+		n++
+	}
+	return n
+}
+
+// GetAt returns the value key had at ts, a timestamp in nanoseconds like
+// timestamp.GetTimestamp. Reads further back than VersionRetention fail
+// with ErrTimestampNotRetained.
+func (lsm *Lsm) GetAt(key string, ts int64) (string, error) {
+	if key == "" {
+		return "", ErrEmptyKey
+	}
+	if ts < timestamp.GetTimestamp()-int64(lsm.opts.VersionRetention) {
+		return "", ErrTimestampNotRetained
+	}
+
+	atomic.AddInt64(&lsm.counters.gets, 1)
+
+	lsm.nodeMapLock.RLock()
+	defer lsm.nodeMapLock.RUnlock()
+
+	node := versionAt(lsm.nodeMap[key], ts)
+	if node != nil {
+		atomic.AddInt64(&lsm.counters.memoryHits, 1)
+		if node.deleted {
+			return "", ErrNotFound
+		}
+		return node.value, nil
+	}
+
+	lsm.ssTableMapLock.RLock()
+	defer lsm.ssTableMapLock.RUnlock()
+
+	ids := lsm.sortedSsTableIds()
+	for i := len(ids) - 1; i >= 0; i-- {
+		st := lsm.ssTableMap[ids[i]]
+		if st.minTimestamp > ts {
+			continue
+		}
+
+		atomic.AddInt64(&lsm.counters.tableProbes, 1)
+		node, err := st.getAt(key, ts)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if node.deleted {
+			return "", ErrNotFound
+		}
+		return node.value, nil
+	}
+	return "", ErrNotFound
+}
+
+func (cf *ColumnFamily) GetAt(key string, ts int64) (string, error) {
+	if cf.dropped() {
+		return "", ErrColumnFamilyNotFound
+	}
+	return cf.lsm.GetAt(key, ts)
+}
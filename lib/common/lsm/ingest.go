@@ -0,0 +1,151 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// ingestTable copies the records of st into a new table at dstPath. They
+// are stamped with the next sequences and the current time, as if they were
+// written now. Must be called with nodeMapLock held.
+func (lsm *Lsm) ingestTable(st *SsTable, dstPath string) (*SsTable, error) {
+	it, err := newTableIterator(st, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer it.close()
+
+	tmpPath := dstPath + ".tmp"
+	file, err := lsm.fs.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &countingWriter{w: lsm.flushThrottle().writer(file)}
+	c, err := writeFileHeader(w, lsm.opts.KeyProvider)
+	for err == nil && it.node != nil {
+		lsm.stampNode(it.node)
+		err = it.node.writeTo(w, c, w.n)
+		if err == nil {
+			err = it.next()
+		}
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = lsm.fs.Rename(tmpPath, dstPath)
+	}
+	if err != nil {
+		lsm.fs.Remove(tmpPath)
+		return nil, err
+	}
+
+	err = lsm.fs.SyncDir(filepath.Dir(dstPath))
+	if err != nil {
+		lsm.fs.Remove(dstPath)
+		return nil, err
+	}
+
+	newSt, err := openSsTable(lsm.fs, lsm.log, dstPath, lsm.codec())
+	if err != nil {
+		lsm.fs.Remove(dstPath)
+		return nil, err
+	}
+	return newSt, nil
+}
+
+// IngestExternalFiles adds tables built by SsTableWriter. Each file gets a
+// new table id above every existing one, later files in the list shadow
+// earlier ones. The memory nodes are flushed first so the ingested data is
+// the newest. The records are copied with new
+// sequences and the current time, they don't go through the log, so
+// subscriptions don't see them. Readers see all files or none of them.
+// The source files are left in place.
+func (lsm *Lsm) IngestExternalFiles(filePaths []string) error {
+	if lsm.readOnly {
+		return ErrReadOnly
+	}
+	if len(filePaths) == 0 {
+		return nil
+	}
+
+	lsm.log.Pf(0, "ingest %d files", len(filePaths))
+
+	srcs := make([]*SsTable, 0, len(filePaths))
+	defer func() {
+		for _, st := range srcs {
+			st.Close()
+		}
+	}()
+
+	size := int64(0)
+	for _, filePath := range filePaths {
+		r, err := verifyFile(lsm.fs, lsm.codec(), filePath, true)
+		if err != nil {
+			return err
+		}
+		if !r.Ok() {
+			return fmt.Errorf("Ingest file %s is corrupt at offset %d: %v",
+				filePath, r.Corrupt[0].Offset, r.Corrupt[0].Err)
+		}
+
+		st, err := openSsTable(lsm.fs, lsm.log, filePath, lsm.codec())
+		if err != nil {
+			return err
+		}
+		size += st.size
+		srcs = append(srcs, st)
+	}
+
+	lsm.nodeMapLock.Lock()
+	defer lsm.nodeMapLock.Unlock()
+
+	// Replay skips the log records a table of their family holds, so none
+	// may be left older than the ingested ones
+	if len(lsm.nodeMap) != 0 {
+		err := lsm.flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := lsm.checkFreeSpace(size)
+	if err != nil {
+		return err
+	}
+
+	tables := make(map[int64]*SsTable)
+	for _, src := range srcs {
+		id := atomic.AddInt64(&lsm.time, 1)
+		st, err := lsm.ingestTable(src, lsm.getSsTablePath(id))
+		if err == nil {
+			tables[id] = st
+			continue
+		}
+
+		for _, st := range tables {
+			st.Erase()
+		}
+		return lsm.spaceError(err)
+	}
+
+	lsm.mergeLock.Lock()
+	defer lsm.mergeLock.Unlock()
+	lsm.ssTableMapLock.Lock()
+	defer lsm.ssTableMapLock.Unlock()
+
+	for id, st := range tables {
+		lsm.addSsTable(id, st)
+		lsm.log.Pf(0, "ingested %s", st.filePath)
+	}
+
+	err = lsm.placeSsTables()
+	if err != nil {
+		lsm.backgroundError("place tables", err)
+	}
+	return nil
+}
@@ -0,0 +1,523 @@
+package lsm
+
+import (
+	"io"
+	"math"
+	"sort"
+
+	"github.com/irqlevel/naiv/lib/common/timestamp"
+	"github.com/irqlevel/naiv/lib/common/vfs"
+)
+
+// cursor walks the nodes of one source in key order in both directions.
+// node is nil once the cursor runs off either end.
+type cursor interface {
+	last() error
+	// seek moves to the first node with a key >= key
+	seek(key string) error
+	// seekForPrev moves to the last node with a key <= key
+	seekForPrev(key string) error
+	next() error
+	prev() error
+	node() *LsmNode
+	close()
+}
+
+// memoryCursor walks a sorted copy of the memory nodes as of ts.
+type memoryCursor struct {
+	nodes []*LsmNode
+	pos   int
+}
+
+func newMemoryCursor(nodeMap map[string]*LsmNode, start string, end string, ts int64) *memoryCursor {
+	c := &memoryCursor{nodes: make([]*LsmNode, 0)}
+	for key, node := range nodeMap {
+		if !keyInRange(key, start, end) {
+			continue
+		}
+		node = versionAt(node, ts)
+		if node != nil {
+			c.nodes = append(c.nodes, node)
+		}
+	}
+	sort.Slice(c.nodes, func(i, j int) bool { return c.nodes[i].key < c.nodes[j].key })
+	return c
+}
+
+func (c *memoryCursor) last() error {
+	c.pos = len(c.nodes) - 1
+	return nil
+}
+
+func (c *memoryCursor) seek(key string) error {
+	c.pos = sort.Search(len(c.nodes), func(i int) bool { return c.nodes[i].key >= key })
+	return nil
+}
+
+func (c *memoryCursor) seekForPrev(key string) error {
+	c.pos = sort.Search(len(c.nodes), func(i int) bool { return c.nodes[i].key > key }) - 1
+	return nil
+}
+
+func (c *memoryCursor) next() error {
+	if c.node() != nil {
+		c.pos++
+	}
+	return nil
+}
+
+func (c *memoryCursor) prev() error {
+	if c.node() != nil {
+		c.pos--
+	}
+	return nil
+}
+
+func (c *memoryCursor) node() *LsmNode {
+	if c.pos < 0 || c.pos >= len(c.nodes) {
+		return nil
+	}
+	return c.nodes[c.pos]
+}
+
+func (c *memoryCursor) close() {
+}
+
+// tableCursor walks a table one index block at a time, a block is read
+// whole so it can be walked backwards. Only the version of each key as of
+// ts is kept, so a block may turn out empty. It reads through its own file
+// handle, so the table stays readable after a merge removes it.
+type tableCursor struct {
+	file        vfs.File
+	filePath    string
+	keys        []string
+	keyToOffset map[string]int64
+	size        int64
+	cipher      *fileCipher
+	limits      sizeLimits
+	ts          int64
+
+	blockIndex int
+	block      []*LsmNode
+	pos        int
+}
+
+func newTableCursor(st *SsTable, ts int64) (*tableCursor, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	if st.file == nil {
+		return nil, ErrTableClosed
+	}
+
+	file, err := st.fs.Open(st.filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &tableCursor{file: file, filePath: st.filePath, keys: st.keys, keyToOffset: st.keyToOffset,
+		size: st.size, cipher: st.cipher, limits: st.codec.limits, ts: ts, blockIndex: -1}, nil
+}
+
+// load reads index block i, the cursor is off the table if there is none.
+func (c *tableCursor) load(i int) error {
+	c.blockIndex = i
+	c.block = c.block[:0]
+	c.pos = 0
+	if i < 0 || i >= len(c.keys) {
+		return nil
+	}
+
+	start := c.keyToOffset[c.keys[i]]
+	end := c.size
+	if i+1 < len(c.keys) {
+		end = c.keyToOffset[c.keys[i+1]]
+	}
+
+	nr := &nodeReader{r: io.NewSectionReader(c.file, start, end-start), filePath: c.filePath,
+		offset: start, cipher: c.cipher, limits: c.limits}
+	var prevKey *string
+	for {
+		node, err := nr.next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			c.block = c.block[:0]
+			return err
+		}
+
+		// Versions of a key come newest first, the first one as of ts wins
+		if prevKey != nil && node.key == *prevKey {
+			continue
+		}
+		if node.timestamp <= c.ts {
+			c.block = append(c.block, node)
+			prevKey = &node.key
+		}
+	}
+}
+
+// forward loads the first block from i on which isn't empty.
+func (c *tableCursor) forward(i int) error {
+	for {
+		err := c.load(i)
+		if err != nil || len(c.block) > 0 || i >= len(c.keys) {
+			return err
+		}
+		i++
+	}
+}
+
+// backward loads the last block from i back which isn't empty and moves to
+// its last node.
+func (c *tableCursor) backward(i int) error {
+	for {
+		err := c.load(i)
+		c.pos = len(c.block) - 1
+		if err != nil || len(c.block) > 0 || i < 0 {
+			return err
+		}
+		i--
+	}
+}
+
+// blockOf returns the index block which may hold key, -1 if key is before
+// the table.
+func (c *tableCursor) blockOf(key string) int {
+	i := sort.SearchStrings(c.keys, key)
+	if i == len(c.keys) || c.keys[i] != key {
+		i--
+	}
+	return i
+}
+
+func (c *tableCursor) last() error {
+	return c.backward(len(c.keys) - 1)
+}
+
+func (c *tableCursor) seek(key string) error {
+	i := c.blockOf(key)
+	if i < 0 {
+		i = 0
+	}
+	err := c.load(i)
+	if err != nil {
+		return err
+	}
+
+	c.pos = sort.Search(len(c.block), func(j int) bool { return c.block[j].key >= key })
+	if c.pos == len(c.block) {
+		return c.forward(i + 1)
+	}
+	return nil
+}
+
+func (c *tableCursor) seekForPrev(key string) error {
+	i := c.blockOf(key)
+	err := c.load(i)
+	if err != nil {
+		return err
+	}
+	c.pos = sort.Search(len(c.block), func(j int) bool { return c.block[j].key > key }) - 1
+	if c.pos < 0 {
+		return c.backward(i - 1)
+	}
+	return nil
+}
+
+func (c *tableCursor) next() error {
+	if c.node() == nil {
+		return nil
+	}
+	c.pos++
+	if c.pos == len(c.block) {
+		return c.forward(c.blockIndex + 1)
+	}
+	return nil
+}
+
+func (c *tableCursor) prev() error {
+	if c.node() == nil {
+		return nil
+	}
+	c.pos--
+	if c.pos < 0 {
+		return c.backward(c.blockIndex - 1)
+	}
+	return nil
+}
+
+func (c *tableCursor) node() *LsmNode {
+	if c.pos < 0 || c.pos >= len(c.block) {
+		return nil
+	}
+	return c.block[c.pos]
+}
+
+func (c *tableCursor) close() {
+	c.file.Close()
+}
+
+// Iterator walks the live keys of a snapshot of the Lsm taken when it was
+// made, in both directions. Writes made later are not seen. An Iterator is
+// not safe for concurrent use and must be closed.
+type Iterator struct {
+	// cursors are ordered newest first, the first one holding a key has
+	// its current version
+	cursors []cursor
+	start   string
+	end     string
+	forward bool
+	current *LsmNode
+	err     error
+}
+
+// prefixEnd returns the first key after every key starting with prefix,
+// empty if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// NewIterator returns an unpositioned iterator over the keys in [start, end),
+// an empty bound is open. Tables which can't hold such keys are skipped.
+func (lsm *Lsm) NewIterator(start string, end string) (*Iterator, error) {
+	return lsm.NewIteratorAt(start, end, math.MaxInt64)
+}
+
+// NewIteratorAt is NewIterator over the keys and values as they were at ts,
+// which must be within VersionRetention like for GetAt.
+func (lsm *Lsm) NewIteratorAt(start string, end string, ts int64) (*Iterator, error) {
+	if ts < timestamp.GetTimestamp()-int64(lsm.opts.VersionRetention) {
+		return nil, ErrTimestampNotRetained
+	}
+
+	lsm.nodeMapLock.RLock()
+	defer lsm.nodeMapLock.RUnlock()
+
+	it := &Iterator{start: start, end: end, forward: true}
+	it.cursors = append(it.cursors, newMemoryCursor(lsm.nodeMap, start, end, ts))
+
+	lsm.ssTableMapLock.RLock()
+	defer lsm.ssTableMapLock.RUnlock()
+
+	ids := make([]int64, 0, len(lsm.ssTableMap))
+	for id := range lsm.ssTableMap {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+
+	for _, id := range ids {
+		st := lsm.ssTableMap[id]
+		if !tableOverlaps(st, start, end) || st.minTimestamp > ts {
+			continue
+		}
+
+		c, err := newTableCursor(st, ts)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.cursors = append(it.cursors, c)
+	}
+	return it, nil
+}
+
+// NewPrefixIterator returns an iterator over the keys starting with prefix.
+func (lsm *Lsm) NewPrefixIterator(prefix string) (*Iterator, error) {
+	return lsm.NewIterator(prefix, prefixEnd(prefix))
+}
+
+func (it *Iterator) fail(err error) {
+	it.err = err
+	it.current = nil
+}
+
+// each runs f on every cursor and stops at the first error.
+func (it *Iterator) each(f func(c cursor) error) bool {
+	for _, c := range it.cursors {
+		err := f(c)
+		if err != nil {
+			it.fail(err)
+			return false
+		}
+	}
+	return true
+}
+
+// skip moves every cursor standing on key one step on.
+func (it *Iterator) skip(key string) bool {
+	return it.each(func(c cursor) error {
+		if n := c.node(); n != nil && n.key == key {
+			if it.forward {
+				return c.next()
+			}
+			return c.prev()
+		}
+		return nil
+	})
+}
+
+// settle makes current the nearest live key in the iterator's direction,
+// stepping over tombstones and keys out of bounds.
+func (it *Iterator) settle() {
+	for {
+		var best *LsmNode
+		for _, c := range it.cursors {
+			n := c.node()
+			if n == nil {
+				continue
+			}
+			if best == nil || (it.forward && n.key < best.key) || (!it.forward && n.key > best.key) {
+				best = n
+			}
+		}
+
+		if best == nil || (it.forward && it.end != "" && best.key >= it.end) ||
+			(!it.forward && best.key < it.start) {
+			it.current = nil
+			return
+		}
+
+		if !best.deleted && keyInRange(best.key, it.start, it.end) {
+			it.current = best
+			return
+		}
+
+		if !it.skip(best.key) {
+			return
+		}
+	}
+}
+
+// SeekToFirst moves to the first key.
+func (it *Iterator) SeekToFirst() {
+	it.Seek(it.start)
+}
+
+// SeekToLast moves to the last key.
+func (it *Iterator) SeekToLast() {
+	if it.end != "" {
+		it.SeekForPrev(it.end)
+		return
+	}
+
+	it.err = nil
+	it.forward = false
+	if it.each(func(c cursor) error { return c.last() }) {
+		it.settle()
+	}
+}
+
+// Seek moves to the first key >= key.
+func (it *Iterator) Seek(key string) {
+	if key < it.start {
+		key = it.start
+	}
+
+	it.err = nil
+	it.forward = true
+	if it.each(func(c cursor) error { return c.seek(key) }) {
+		it.settle()
+	}
+}
+
+// SeekForPrev moves to the last key <= key.
+func (it *Iterator) SeekForPrev(key string) {
+	it.err = nil
+	it.forward = false
+	if it.each(func(c cursor) error { return c.seekForPrev(key) }) {
+		it.settle()
+	}
+}
+
+// Next moves to the following key.
+func (it *Iterator) Next() {
+	if it.current == nil {
+		return
+	}
+	key := it.current.key
+
+	// Cursors behind the current key are moved past it first
+	if !it.forward {
+		it.forward = true
+		if !it.each(func(c cursor) error { return c.seek(key) }) {
+			return
+		}
+	}
+	if it.skip(key) {
+		it.settle()
+	}
+}
+
+// Prev moves to the preceding key.
+func (it *Iterator) Prev() {
+	if it.current == nil {
+		return
+	}
+	key := it.current.key
+
+	if it.forward {
+		it.forward = false
+		if !it.each(func(c cursor) error { return c.seekForPrev(key) }) {
+			return
+		}
+	}
+	if it.skip(key) {
+		it.settle()
+	}
+}
+
+// Valid reports whether the iterator stands on a key. It is false at either
+// end and after an error.
+func (it *Iterator) Valid() bool {
+	return it.current != nil
+}
+
+func (it *Iterator) Key() string {
+	return it.current.key
+}
+
+func (it *Iterator) Value() string {
+	return it.current.value
+}
+
+// Err returns the error which made the iterator invalid, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+func (it *Iterator) Close() {
+	for _, c := range it.cursors {
+		c.close()
+	}
+	it.cursors = nil
+	it.current = nil
+}
+
+func (cf *ColumnFamily) NewIterator(start string, end string) (*Iterator, error) {
+	if cf.dropped() {
+		return nil, ErrColumnFamilyNotFound
+	}
+	return cf.lsm.NewIterator(start, end)
+}
+
+func (cf *ColumnFamily) NewIteratorAt(start string, end string, ts int64) (*Iterator, error) {
+	if cf.dropped() {
+		return nil, ErrColumnFamilyNotFound
+	}
+	return cf.lsm.NewIteratorAt(start, end, ts)
+}
+
+func (cf *ColumnFamily) NewPrefixIterator(prefix string) (*Iterator, error) {
+	if cf.dropped() {
+		return nil, ErrColumnFamilyNotFound
+	}
+	return cf.lsm.NewPrefixIterator(prefix)
+}
@@ -0,0 +1,56 @@
+package lsm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/irqlevel/naiv/lib/common/vfs"
+)
+
+var (
+	ErrLsmLocked = fmt.Errorf("Lsm directory is used by another instance")
+)
+
+const (
+	lockFileName = "LOCK"
+)
+
+// lockDir takes an exclusive lock on the LOCK file in rootPath. The lock
+// belongs to the open file, so a second open in the same process fails too.
+func lockDir(fs vfs.FS, rootPath string) (io.Closer, error) {
+	lock, err := fs.Lock(filepath.Join(rootPath, lockFileName), true)
+	if err != nil {
+		if err == vfs.ErrLocked {
+			return nil, ErrLsmLocked
+		}
+		return nil, err
+	}
+	return lock, nil
+}
+
+// lockDirShared takes a shared lock on the LOCK file, so a primary can't
+// start while the directory is read. The file is created if missing, a
+// shared lock doesn't create it.
+func lockDirShared(fs vfs.FS, rootPath string) (io.Closer, error) {
+	filePath := filepath.Join(rootPath, lockFileName)
+	file, err := fs.OpenFile(filePath, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	lock, err := fs.Lock(filePath, false)
+	if err != nil {
+		if err == vfs.ErrLocked {
+			return nil, ErrLsmLocked
+		}
+		return nil, err
+	}
+	return lock, nil
+}
+
+func unlockDir(lock io.Closer) {
+	lock.Close()
+}
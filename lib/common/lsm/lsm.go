@@ -1,20 +1,21 @@
 package lsm
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	log "github.com/irqlevel/naiv/lib/common/log"
+	"github.com/irqlevel/naiv/lib/common/ratelimit"
+	"github.com/irqlevel/naiv/lib/common/timestamp"
+	"github.com/irqlevel/naiv/lib/common/vfs"
 )
 
 var (
@@ -27,125 +28,357 @@ var (
 const (
 	logFileName        = "lsm.log"
 	maxMemoryNodeCount = 100
+	maxSsTableCount    = 8
 	mergeTimeoutMs     = 1000
 	compactTimeoutMs   = 1000
 )
 
+type LsmOptions struct {
+	// ArchiveLog moves the log into a numbered segment under ArchivePath
+	// on every flush instead of truncating it. Segments last written more
+	// than ArchiveRetention ago are removed, zero keeps them until
+	// PruneArchive.
+	ArchiveLog       bool
+	ArchivePath      string
+	ArchiveRetention time.Duration
+
+	EventListener EventListener
+
+	// RateLimiter throttles bytes written by flushes and merges, flushes
+	// have priority. Its rate may be changed at any time, nil means no limit.
+	RateLimiter *ratelimit.RateLimiter
+
+	// CatchUpInterval is how often a secondary instance looks for new
+	// data of the primary.
+	CatchUpInterval time.Duration
+
+	// FS is the file system the Lsm lives in, nil means the operating
+	// system one.
+	FS vfs.FS
+
+	// Sync makes every log write durable before Set or Delete returns.
+	// Tables are always synced before the log records they hold are
+	// dropped.
+	Sync bool
+
+	// ColumnFamilyOptions are the options of column families found when
+	// the Lsm is opened, by family name.
+	ColumnFamilyOptions map[string]*LsmOptions
+
+	// MaxKeySize and MaxValueSize bound the size of keys and values, zero
+	// means DefaultMaxKeySize and DefaultMaxValueSize. Larger records found
+	// on disk are reported as corrupt.
+	MaxKeySize   int
+	MaxValueSize int
+
+	// DataPaths are the directories tables are kept in, fastest first.
+	// Flushes write into the first one, compaction moves older tables to
+	// the following ones as each fills up to its target size. Empty means
+	// rootPath, which always holds the log.
+	DataPaths []DataPath
+
+	// KeyProvider turns on AES-GCM encryption of the log and the tables,
+	// each file with its own data key wrapped by the current master key.
+	// Files written before it was set stay plain text until they are
+	// rewritten.
+	KeyProvider KeyProvider
+
+	// CompactionPolicy picks the tables merged or dropped after a flush,
+	// nil means SizeTieredCompactionPolicy.
+	CompactionPolicy CompactionPolicy
+
+	// WriteStall slows down and stops writes while flushes and merges fall
+	// behind. The thresholds of the Lsm cover its column families too.
+	WriteStall WriteStallOptions
+
+	// SpaceQuota bounds the bytes of the log and the tables of the Lsm and
+	// its column families, zero means no quota. FreeSpaceReserve is how
+	// many bytes are kept free on every path the Lsm writes to. A write
+	// over either one fails with ErrNoSpace, as do all writes after the
+	// disk filled up until space is freed.
+	SpaceQuota       int64
+	FreeSpaceReserve int64
+
+	// VersionRetention is how long replaced and deleted versions are kept
+	// for GetAt and NewIteratorAt. Merges drop a version only once the one
+	// which replaced it is older than that, zero keeps no history.
+	VersionRetention time.Duration
+
+	// MaxSubcompactions is how many goroutines a CompactRange of at least
+	// SubcompactionMinSize bytes is split into, each one merging a range
+	// of keys into its own table. Zero or one merges in one goroutine,
+	// a zero SubcompactionMinSize means 64MB.
+	MaxSubcompactions    int
+	SubcompactionMinSize int64
+}
+
+func DefaultLsmOptions() *LsmOptions {
+	opts := new(LsmOptions)
+	opts.EventListener = NopEventListener{}
+	return opts
+}
+
 type Lsm struct {
-	nodeMap        map[string]*LsmNode
-	nodeMapLock    sync.RWMutex
-	rootPath       string
-	logFile        *os.File
-	ssTableMap     map[int64]*SsTable
-	ssTableMapLock sync.RWMutex
-	time           int64
-	mergeTimer     *time.Ticker
-	compactTimer   *time.Ticker
-	compactChan    chan bool
-	stopChan       chan bool
-	closing        bool
+	nodeMap           map[string]*LsmNode
+	nodeMapLock       sync.RWMutex
+	rootPath          string
+	fs                vfs.FS
+	logFile           vfs.File
+	logCipher         *fileCipher
+	logSize           int64
+	lockFile          io.Closer
+	ssTableMap        map[int64]*SsTable
+	ssTableMapLock    sync.RWMutex
+	time              int64
+	seq               uint64
+	opts              LsmOptions
+	counters          *lsmCounters
+	mergeTimer        *time.Ticker
+	compactTimer      *time.Ticker
+	catchUpTimer      *time.Ticker
+	readOnly          bool
+	subscriptions     map[*Subscription]bool
+	subscriptionsLock sync.Mutex
+	// root is the default column family, it owns the log. It points to
+	// the Lsm itself unless this is another column family.
+	root        *Lsm
+	family      *columnFamilyRecord
+	families    map[uint32]*Lsm
+	manifest    *familyManifest
+	dropped     bool
+	compactChan chan bool
+	stopChan    chan bool
+	closing     bool
+	// noSpace is set on the root while writes are stopped for lack of space
+	noSpace        int32
+	noSpaceChecked time.Time
 	wg             sync.WaitGroup
 	log            log.LogInterface
+	// mergeLock serializes merges and other steps which replace tables,
+	// it is taken before ssTableMapLock
+	mergeLock sync.Mutex
 }
 
 func (lsm *Lsm) compact() error {
-	if len(lsm.nodeMap) < maxMemoryNodeCount {
+	full := len(lsm.nodeMap) >= maxMemoryNodeCount
+	for _, family := range lsm.families {
+		if len(family.nodeMap) >= maxMemoryNodeCount {
+			full = true
+		}
+	}
+	if !full {
 		return nil
 	}
 
-	nodeMap := lsm.nodeMap
-	time := atomic.AddInt64(&lsm.time, 1)
-	lsm.log.Pf(0, "compacting %d size %d", time, len(nodeMap))
-	st, err := newSsTable(lsm.log, lsm.getSsTablePath(time), nodeMap)
+	return lsm.flush()
+}
+
+// flush writes the memory nodes into a new table whatever their count.
+// The default column family flushes every other family too and then drops
+// the log. Must be called with nodeMapLock held for writing.
+func (lsm *Lsm) flush() error {
+	if lsm.root != lsm {
+		_, err := lsm.flushMemory()
+		return err
+	}
+
+	id, err := lsm.flushMemory()
 	if err != nil {
 		return err
 	}
 
-	lsm.ssTableMapLock.Lock()
-	defer lsm.ssTableMapLock.Unlock()
-	lsm.ssTableMap[time] = st
-	lsm.mergeSsTables()
+	for _, family := range lsm.families {
+		family.nodeMapLock.Lock()
+		familyId, err := family.flushMemory()
+		family.nodeMapLock.Unlock()
+		if err != nil {
+			return err
+		}
+		if familyId != 0 && id == 0 {
+			id = atomic.AddInt64(&lsm.time, 1)
+		}
+	}
 
-	lsm.nodeMap = make(map[string]*LsmNode)
+	if id == 0 {
+		return nil
+	}
 
-	err = lsm.logFile.Truncate(0)
+	err = lsm.rotateLog(id)
 	if err != nil {
-		lsm.log.Pf(0, "truncate error %v", err)
+		lsm.backgroundError("rotate log", err)
 	}
-	lsm.log.Pf(0, "compacted %d size %d", time, len(nodeMap))
 	return nil
 }
 
-func (lsm *Lsm) mergeSsTables() error {
-	if len(lsm.ssTableMap) <= 8 {
-		return nil
+// flushMemory writes the memory nodes into a new table and returns its id,
+// zero if there was nothing to write.
+func (lsm *Lsm) flushMemory() (int64, error) {
+	if len(lsm.nodeMap) == 0 {
+		return 0, nil
 	}
 
-	ids := make([]int64, len(lsm.ssTableMap))
-	i := 0
-	for id := range lsm.ssTableMap {
-		ids[i] = id
-		i++
+	begin := time.Now()
+	nodeMap := lsm.nodeMap
+	err := lsm.checkFreeSpace(memorySize(nodeMap))
+	if err != nil {
+		return 0, lsm.spaceError(err)
 	}
 
-	//sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
-
-	for i := len(ids) - 1; i >= 0; i -= 2 {
-		j := i + 1
-		if j >= len(ids) {
-			continue
-		}
+	time := atomic.AddInt64(&lsm.time, 1)
+	lsm.log.Pf(0, "compacting %d size %d", time, len(nodeMap))
+	info := FlushInfo{TableId: time, Count: len(nodeMap)}
+	lsm.opts.EventListener.OnFlushBegin(info)
+	st, err := newSsTable(lsm.fs, lsm.log, lsm.getSsTablePath(time), nodeMap, lsm.flushThrottle(),
+		lsm.codec())
+	if err != nil {
+		info.Duration = sinceDuration(begin)
+		lsm.opts.EventListener.OnFlushCompleted(info)
+		return 0, lsm.spaceError(err)
+	}
+	atomic.AddInt64(&lsm.counters.flushes, 1)
+	atomic.AddInt64(&lsm.counters.tableBytes, st.size)
 
-		prevStId := ids[i]
-		currStId := ids[j]
+	lsm.ssTableMapLock.Lock()
+	lsm.addSsTable(time, st)
+	lsm.ssTableMapLock.Unlock()
+	// Writers wait only for the flush, merges run in the background
+	lsm.root.scheduleMerge()
 
-		prevSt := lsm.ssTableMap[prevStId]
-		currSt := lsm.ssTableMap[currStId]
+	lsm.nodeMap = make(map[string]*LsmNode)
 
-		lsm.log.Pf(0, "merge %d %d -> %d", prevStId, currStId, currStId)
+	lsm.counters.flushDuration.Append(sinceUs(begin))
+	info.Size = st.size
+	info.Duration = sinceDuration(begin)
+	lsm.opts.EventListener.OnFlushCompleted(info)
+	lsm.log.Pf(0, "compacted %d size %d", time, len(nodeMap))
+	return time, nil
+}
 
-		tmpFilePath := lsm.getSsTablePath(atomic.AddInt64(&lsm.time, 1))
-		err := currSt.Merge(prevSt, tmpFilePath)
+func (lsm *Lsm) rotateLog(id int64) error {
+	if !lsm.opts.ArchiveLog {
+		err := lsm.logFile.Truncate(0)
 		if err != nil {
 			return err
 		}
+		return lsm.startLog()
+	}
 
-		newSt, err := openSsTable(lsm.log, tmpFilePath)
-		if err != nil {
-			os.Remove(tmpFilePath)
-			return err
+	return lsm.archiveLog(id)
+}
+
+// startLog writes the header of the empty log with a new data key if
+// encryption is on.
+func (lsm *Lsm) startLog() error {
+	lsm.logSize = 0
+	w := &countingWriter{w: lsm.logFile}
+	c, err := writeFileHeader(w, lsm.opts.KeyProvider)
+	lsm.logSize = w.n
+	if err != nil {
+		lsm.logCipher = nil
+		return lsm.spaceError(err)
+	}
+	lsm.logCipher = c
+	return nil
+}
+
+// olderTablesOverlap checks whether any table older than id may hold keys
+// of the given tables.
+func (lsm *Lsm) olderTablesOverlap(id int64, tables ...*SsTable) bool {
+	for otherId, other := range lsm.ssTableMap {
+		if otherId >= id || other.minKey == nil {
+			continue
 		}
 
-		lsm.ssTableMap[currStId] = newSt
-		delete(lsm.ssTableMap, prevStId)
+		for _, st := range tables {
+			if st.minKey != nil && tableOverlaps(other, *st.minKey, *st.maxKey+"\x00") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (opts *LsmOptions) codec() nodeCodec {
+	return nodeCodec{keys: opts.KeyProvider, limits: newSizeLimits(opts.MaxKeySize, opts.MaxValueSize)}
+}
+
+func (lsm *Lsm) codec() nodeCodec {
+	return lsm.opts.codec()
+}
 
-		currSt.Erase()
-		prevSt.Erase()
+func (lsm *Lsm) stampNode(n *LsmNode) {
+	lsm.seq++
+	n.seq = lsm.seq
+	n.timestamp = timestamp.GetTimestamp()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
 
-		lsm.log.Pf(0, "merge %d %d -> %d done", prevStId, currStId, currStId)
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// appendLog writes n at the end of the log. What a failed write left of it
+// is cut off, records appended later must follow a complete one.
+func (lsm *Lsm) appendLog(n *LsmNode) error {
+	w := &countingWriter{w: lsm.logFile}
+	err := n.writeTo(w, lsm.logCipher, lsm.logSize)
+	if err != nil {
+		if w.n != 0 {
+			lsm.logFile.Truncate(lsm.logSize)
+		}
+		return lsm.spaceError(err)
 	}
+	lsm.logSize += w.n
+	atomic.AddInt64(&lsm.counters.logBytes, n.diskSize())
 	return nil
 }
 
-func (lsm *Lsm) logSet(key string, value string) error {
-	n := newLsmNode(key, value)
-	err := n.WriteTo(lsm.logFile)
+func (lsm *Lsm) writeLog(n *LsmNode) error {
+	logSize := lsm.logSize
+	err := lsm.appendLog(n)
 	if err != nil {
 		return err
 	}
-	//	return lsm.logFile.Sync()
+	if lsm.opts.Sync {
+		err = lsm.logFile.Sync()
+		if err != nil {
+			// The write fails, so the record must not come back on replay
+			lsm.logFile.Truncate(logSize)
+			lsm.logSize = logSize
+			return err
+		}
+	}
+	lsm.publish(n)
 	return nil
 }
 
-func (lsm *Lsm) logDelete(key string) error {
+func (lsm *Lsm) logSet(key string, value string) (*LsmNode, error) {
+	n := newLsmNode(key, value)
+	lsm.stampNode(n)
+	err := lsm.writeLog(n)
+	if err != nil {
+		lsm.seq--
+		return nil, err
+	}
+	return n, nil
+}
+
+func (lsm *Lsm) logDelete(key string) (*LsmNode, error) {
 	n := newLsmNode(key, "")
 	n.deleted = true
-	err := n.WriteTo(lsm.logFile)
+	lsm.stampNode(n)
+	err := lsm.writeLog(n)
 	if err != nil {
-		return err
+		lsm.seq--
+		return nil, err
 	}
-	//return lsm.logFile.Sync()
-	return nil
+	return n, nil
 }
 
 func (lsm *Lsm) Set(key string, value string) error {
@@ -155,23 +388,42 @@ func (lsm *Lsm) Set(key string, value string) error {
 	if value == "" {
 		return ErrEmptyValue
 	}
+	if lsm.readOnly {
+		return ErrReadOnly
+	}
+	err := lsm.codec().limits.check(key, value)
+	if err != nil {
+		return err
+	}
+
+	begin := time.Now()
+	atomic.AddInt64(&lsm.counters.puts, 1)
+	defer func() { lsm.counters.setLatency.Append(sinceUs(begin)) }()
 
 	lsm.nodeMapLock.Lock()
 	defer lsm.nodeMapLock.Unlock()
 
-	err := lsm.logSet(key, value)
+	err = lsm.stallWrite()
 	if err != nil {
 		return err
 	}
 
-	node, ok := lsm.nodeMap[key]
-	if ok {
-		node.value = value
-	} else {
-		lsm.nodeMap[key] = newLsmNode(key, value)
+	err = lsm.checkWriteSpace(recordSize(key, value), false)
+	if err != nil {
+		return err
+	}
+
+	node, err := lsm.logSet(key, value)
+	if err != nil {
+		return err
 	}
 
-	lsm.compact()
+	lsm.putNode(lsm.nodeMap, node)
+
+	err = lsm.compact()
+	if err != nil {
+		lsm.backgroundError("compact", err)
+	}
 
 	return nil
 }
@@ -192,6 +444,7 @@ func (lsm *Lsm) lookupSsTables(key string) (string, error) {
 	for _, id := range ids {
 		st := lsm.ssTableMap[id]
 
+		atomic.AddInt64(&lsm.counters.tableProbes, 1)
 		value, err := st.Get(key)
 		if err == nil {
 			return value, nil
@@ -214,11 +467,16 @@ func (lsm *Lsm) Get(key string) (string, error) {
 		return "", ErrEmptyKey
 	}
 
+	begin := time.Now()
+	atomic.AddInt64(&lsm.counters.gets, 1)
+	defer func() { lsm.counters.getLatency.Append(sinceUs(begin)) }()
+
 	lsm.nodeMapLock.RLock()
 	defer lsm.nodeMapLock.RUnlock()
 
 	node, ok := lsm.nodeMap[key]
 	if ok {
+		atomic.AddInt64(&lsm.counters.memoryHits, 1)
 		if node.deleted {
 			return "", ErrNotFound
 		}
@@ -232,25 +490,42 @@ func (lsm *Lsm) Delete(key string) error {
 	if key == "" {
 		return ErrEmptyKey
 	}
+	if lsm.readOnly {
+		return ErrReadOnly
+	}
+	err := lsm.codec().limits.check(key, "")
+	if err != nil {
+		return err
+	}
+
+	begin := time.Now()
+	atomic.AddInt64(&lsm.counters.deletes, 1)
+	defer func() { lsm.counters.deleteLatency.Append(sinceUs(begin)) }()
 
 	lsm.nodeMapLock.Lock()
 	defer lsm.nodeMapLock.Unlock()
 
-	err := lsm.logDelete(key)
+	err = lsm.stallWrite()
 	if err != nil {
 		return err
 	}
 
-	node, ok := lsm.nodeMap[key]
-	if ok {
-		node.deleted = true
-	} else {
-		n := newLsmNode(key, "")
-		n.deleted = true
-		lsm.nodeMap[key] = n
+	err = lsm.checkWriteSpace(recordSize(key, ""), true)
+	if err != nil {
+		return err
 	}
 
-	lsm.compact()
+	node, err := lsm.logDelete(key)
+	if err != nil {
+		return err
+	}
+
+	lsm.putNode(lsm.nodeMap, node)
+
+	err = lsm.compact()
+	if err != nil {
+		lsm.backgroundError("compact", err)
+	}
 	return nil
 }
 
@@ -265,37 +540,67 @@ func (lsm *Lsm) Close() {
 
 	lsm.mergeTimer.Stop()
 	lsm.compactTimer.Stop()
+	if lsm.catchUpTimer != nil {
+		lsm.catchUpTimer.Stop()
+	}
 
 	lsm.wg.Wait()
+	lsm.closeSubscriptions()
 
 	lsm.nodeMapLock.Lock()
 	defer lsm.nodeMapLock.Unlock()
 
 	lsm.closeSsTables()
-	lsm.logFile.Close()
+	lsm.closeFamilies()
+	if lsm.logFile != nil {
+		lsm.logFile.Close()
+	}
+	if lsm.lockFile != nil {
+		unlockDir(lsm.lockFile)
+	}
 }
 
 func (lsm *Lsm) Background() {
 	defer lsm.wg.Done()
 
+	var catchUpChan <-chan time.Time
+	if lsm.catchUpTimer != nil {
+		catchUpChan = lsm.catchUpTimer.C
+	}
+
 	for {
 		select {
+		case <-catchUpChan:
+			err := lsm.TryCatchUpWithPrimary()
+			if err != nil {
+				lsm.backgroundError("catch up", err)
+			}
 		case <-lsm.mergeTimer.C:
-			//lsm.mergeSsTables()
+			//lsm.compactSsTables()
 		case <-lsm.compactTimer.C:
 			//lsm.compact()
-			//lsm.mergeSsTables()
+			//lsm.compactSsTables()
 		case <-lsm.compactChan:
-			//lsm.compact(false, true)
-			//lsm.mergeSsTables()
+			err := lsm.runMerges()
+			if err != nil {
+				lsm.backgroundError("merge", err)
+			}
 		case <-lsm.stopChan:
 			return
 		}
 	}
 }
 
-func newLsm(log log.LogInterface, rootPath string, logFile *os.File) *Lsm {
+func newLsm(log log.LogInterface, rootPath string, logFile vfs.File, opts *LsmOptions) *Lsm {
 	lsm := new(Lsm)
+	lsm.opts = *opts
+	if lsm.opts.EventListener == nil {
+		lsm.opts.EventListener = NopEventListener{}
+	}
+	if lsm.opts.ArchivePath == "" {
+		lsm.opts.ArchivePath = filepath.Join(rootPath, archiveDirName)
+	}
+	lsm.fs = lsmFS(opts)
 	lsm.nodeMap = make(map[string]*LsmNode)
 	lsm.ssTableMap = make(map[int64]*SsTable)
 	lsm.rootPath = rootPath
@@ -305,39 +610,86 @@ func newLsm(log log.LogInterface, rootPath string, logFile *os.File) *Lsm {
 	lsm.mergeTimer = time.NewTicker(mergeTimeoutMs * time.Millisecond)
 	lsm.compactTimer = time.NewTicker(compactTimeoutMs * time.Millisecond)
 	lsm.log = log
+	lsm.counters = newLsmCounters()
+	lsm.subscriptions = make(map[*Subscription]bool)
+	lsm.root = lsm
+	lsm.families = make(map[uint32]*Lsm)
+	lsm.manifest = newFamilyManifest()
 	return lsm
 }
 
+func lsmFS(opts *LsmOptions) vfs.FS {
+	if opts.FS == nil {
+		return vfs.Default
+	}
+	return opts.FS
+}
+
 func (lsm *Lsm) start() {
 	lsm.wg.Add(1)
 	go lsm.Background()
 }
 
 func NewLsm(log log.LogInterface, rootPath string) (*Lsm, error) {
+	return NewLsmWithOptions(log, rootPath, DefaultLsmOptions())
+}
+
+func NewLsmWithOptions(log log.LogInterface, rootPath string, opts *LsmOptions) (*Lsm, error) {
 	log.Pf(0, "new")
 	rootPath, err := filepath.Abs(rootPath)
 	if err != nil {
 		return nil, err
 	}
 
-	err = os.MkdirAll(rootPath, 0700)
+	fs := lsmFS(opts)
+	err = fs.MkdirAll(rootPath, 0700)
 	if err != nil {
 		return nil, err
 	}
 
-	logFile, err := os.OpenFile(filepath.Join(rootPath, logFileName),
+	lockFile, err := lockDir(fs, rootPath)
+	if err != nil {
+		log.Pf(0, "lock %s error %v", rootPath, err)
+		return nil, err
+	}
+
+	logFile, err := fs.OpenFile(filepath.Join(rootPath, logFileName),
 		os.O_APPEND|os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
+		unlockDir(lockFile)
+		return nil, err
+	}
+
+	lsm := newLsm(log, rootPath, logFile, opts)
+	lsm.lockFile = lockFile
+	err = lsm.makeDataPaths()
+	if err == nil {
+		err = lsm.startLog()
+	}
+	if err == nil {
+		err = fs.SyncDir(rootPath)
+	}
+	if err != nil {
+		logFile.Close()
+		unlockDir(lockFile)
 		return nil, err
 	}
 
-	lsm := newLsm(log, rootPath, logFile)
+	if lsm.opts.ArchiveLog {
+		err = fs.MkdirAll(lsm.opts.ArchivePath, 0700)
+		if err != nil {
+			logFile.Close()
+			unlockDir(lockFile)
+			return nil, err
+		}
+	}
 	lsm.start()
 	return lsm, nil
 }
 
+// getSsTablePath returns where a new table goes, the first data path.
 func (lsm *Lsm) getSsTablePath(index int64) string {
-	return path.Join(lsm.rootPath, "lsm_"+strconv.FormatInt(index, 10)+".sstable")
+	return getSsTablePathIn(lsm.dataPaths()[0].Path, index)
 }
 
 func (lsm *Lsm) closeSsTables() {
@@ -347,54 +699,142 @@ func (lsm *Lsm) closeSsTables() {
 }
 
 func (lsm *Lsm) openSsTables() error {
-	files, err := ioutil.ReadDir(lsm.rootPath)
+	if !lsm.readOnly {
+		lsm.removeTmpSsTables()
+	}
+
+	tables, err := lsm.findSsTables()
 	if err != nil {
 		return err
 	}
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-
-		match := ssTableFileNamePattern.FindStringSubmatch(file.Name())
-		if match == nil || len(match) == 1 {
-			continue
-		}
-
-		index, err := strconv.ParseInt(match[1], 10, 64)
-		if err != nil {
-			continue
-		}
-
-		st, err := openSsTable(lsm.log, lsm.getSsTablePath(index))
+	for index, filePath := range tables {
+		st, err := openSsTable(lsm.fs, lsm.log, filePath, lsm.codec())
 		if err != nil {
 			if os.IsNotExist(err) {
 				return nil
 			}
 			return err
 		}
-		lsm.ssTableMap[index] = st
+		lsm.addSsTable(index, st)
 		if index > lsm.time {
 			lsm.time = index
 		}
+		if st.maxSeq > lsm.seq {
+			lsm.seq = st.maxSeq
+		}
 	}
 
 	return nil
 }
 
-func (lsm *Lsm) restoreFromLog(logFile *os.File) error {
+// readLog replays logFile into nodeMap. Records of other column families go
+// into their memory nodes, those of dropped families are skipped and so are
+// those the tables of their family hold already, as a family flush leaves
+// the log alone and a crash may come between a flush and the rotation. A
+// write batch cut short by a crash is skipped as a whole, as is a record
+// torn by one at the end of the log. The reader of the log, the offset
+// after the last complete batch and the highest sequence read are returned.
+func (lsm *Lsm) readLog(logFile vfs.File, nodeMap map[string]*LsmNode) (*nodeReader, int64, uint64, error) {
+	nr, err := openNodeReader(logFile, filepath.Join(lsm.rootPath, logFileName), lsm.codec())
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	flushed := map[uint32]uint64{0: lsm.tableSeq()}
+	for id, family := range lsm.families {
+		flushed[id] = family.tableSeq()
+	}
+
+	end := nr.offset
+	seq := uint64(0)
+	batch := make([]*LsmNode, 0)
 	for {
-		n := new(LsmNode)
-		err := n.ReadFrom(logFile)
+		n, err := nr.next()
 		if err != nil {
 			if err == io.EOF {
-				break
+				return nr, end, seq, nil
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				lsm.log.Pf(0, "log ends with a torn record: %v", err)
+				return nr, end, seq, nil
 			}
+			return nil, 0, 0, err
+		}
+
+		if n.seq > seq {
+			seq = n.seq
+		}
+
+		batch = append(batch, n)
+		if n.batchLeft != 0 {
+			continue
+		}
+
+		for _, n := range batch {
+			n.batchLeft = 0
+			if n.seq <= flushed[n.family] {
+				continue
+			}
+			if n.family == 0 {
+				lsm.putNode(nodeMap, n)
+				continue
+			}
+			family, ok := lsm.families[n.family]
+			if ok {
+				family.putNode(family.nodeMap, n)
+			}
+		}
+		batch = batch[:0]
+		end = nr.offset
+	}
+}
+
+// tableSeq returns the highest sequence in the tables.
+func (lsm *Lsm) tableSeq() uint64 {
+	lsm.ssTableMapLock.RLock()
+	defer lsm.ssTableMapLock.RUnlock()
+
+	seq := uint64(0)
+	for _, st := range lsm.ssTableMap {
+		if st.maxSeq > seq {
+			seq = st.maxSeq
+		}
+	}
+	return seq
+}
+
+func (lsm *Lsm) restoreFromLog(logFile vfs.File) error {
+	nr, end, seq, err := lsm.readLog(logFile, lsm.nodeMap)
+	if err != nil {
+		return err
+	}
+	if seq > lsm.seq {
+		lsm.seq = seq
+	}
+
+	// Drop what a crash left of the last batch, records appended from now
+	// on must not complete it
+	info, err := logFile.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > end {
+		lsm.log.Pf(0, "truncate log from %d to %d", info.Size(), end)
+		err = logFile.Truncate(end)
+		if err != nil {
 			return err
 		}
+	}
 
-		lsm.nodeMap[n.key] = n
+	// A plain text log is appended to as is until it is rotated
+	lsm.logCipher = nr.cipher
+	lsm.logSize = end
+	if end == 0 {
+		err = lsm.startLog()
+		if err != nil {
+			return err
+		}
 	}
 
 	lsm.nodeMapLock.Lock()
@@ -403,36 +843,74 @@ func (lsm *Lsm) restoreFromLog(logFile *os.File) error {
 }
 
 func OpenLsm(log log.LogInterface, rootPath string) (*Lsm, error) {
+	return OpenLsmWithOptions(log, rootPath, DefaultLsmOptions())
+}
+
+func OpenLsmWithOptions(log log.LogInterface, rootPath string, opts *LsmOptions) (*Lsm, error) {
 	log.Pf(0, "open")
-	logFile, err := os.OpenFile(filepath.Join(rootPath, logFileName), os.O_RDONLY, 0600)
+	fs := lsmFS(opts)
+	lockFile, err := lockDir(fs, rootPath)
+	if err != nil {
+		log.Pf(0, "lock %s error %v", rootPath, err)
+		return nil, err
+	}
+
+	// The log is kept as is, records restored below stay in it until they
+	// are flushed, so a crash right after open loses nothing.
+	logFile, err := fs.OpenFile(filepath.Join(rootPath, logFileName), os.O_APPEND|os.O_RDWR, 0600)
 	if err != nil {
 		log.Pf(0, "open log error %v", err)
+		unlockDir(lockFile)
 		return nil, err
 	}
 
-	lsm := newLsm(log, rootPath, logFile)
+	lsm := newLsm(log, rootPath, logFile, opts)
+	lsm.lockFile = lockFile
+	if lsm.opts.ArchiveLog {
+		err = fs.MkdirAll(lsm.opts.ArchivePath, 0700)
+		if err != nil {
+			logFile.Close()
+			unlockDir(lockFile)
+			return nil, err
+		}
+	}
+
 	err = lsm.openSsTables()
 	if err != nil {
 		log.Pf(0, "open tables error %v", err)
 		logFile.Close()
+		unlockDir(lockFile)
 		return nil, err
 	}
 
-	err = lsm.restoreFromLog(logFile)
-	logFile.Close()
+	err = lsm.openFamilies()
+	if err == nil {
+		err = lsm.makeDataPaths()
+		for _, family := range lsm.families {
+			if err == nil {
+				err = family.makeDataPaths()
+			}
+		}
+	}
 	if err != nil {
-		log.Pf(0, "restore error %v", err)
+		log.Pf(0, "open column families error %v", err)
 		lsm.closeSsTables()
+		lsm.closeFamilies()
+		logFile.Close()
+		unlockDir(lockFile)
 		return nil, err
 	}
 
-	logFile, err = os.OpenFile(filepath.Join(rootPath, logFileName), os.O_APPEND|os.O_WRONLY|os.O_TRUNC, 0600)
+	err = lsm.restoreFromLog(lsm.logFile)
 	if err != nil {
-		log.Pf(0, "open log error %v", err)
+		log.Pf(0, "restore error %v", err)
 		lsm.closeSsTables()
+		lsm.closeFamilies()
+		lsm.logFile.Close()
+		unlockDir(lockFile)
 		return nil, err
 	}
-	lsm.logFile = logFile
+
 	lsm.start()
 	return lsm, nil
 }
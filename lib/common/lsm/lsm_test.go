@@ -1,13 +1,25 @@
 package lsm
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/irqlevel/naiv/lib/common/filelog"
 	"github.com/irqlevel/naiv/lib/common/log"
 	"github.com/irqlevel/naiv/lib/common/random"
+	"github.com/irqlevel/naiv/lib/common/ratelimit"
+	"github.com/irqlevel/naiv/lib/common/timestamp"
+	"github.com/irqlevel/naiv/lib/common/vfs"
 )
 
 func TestLsmNodeReadWrite(t *testing.T) {
@@ -149,3 +161,3261 @@ func TestLsmCreateOpen(t *testing.T) {
 		}
 	}
 }
+
+func TestLsmArchiveRestore(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmArchiveRestore_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	opts := DefaultLsmOptions()
+	opts.ArchiveLog = true
+	opts.ArchivePath = filepath.Join(rootPath, "archive")
+	lsm, err := NewLsmWithOptions(log, filepath.Join(rootPath, "data"), opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	keys := make([]string, 0)
+	for i := 0; i < 3*maxMemoryNodeCount/2; i++ {
+		key := random.GenerateRandomHexString(16)
+		keys = append(keys, key)
+		err = lsm.Set(key, "base")
+		if err != nil {
+			t.Fatalf("can't set lsm key error %v", err)
+			lsm.Close()
+			return
+		}
+	}
+
+	// A family flush leaves the older records of the root in the log
+	cf, err := lsm.CreateColumnFamily("cf", nil)
+	if err != nil {
+		t.Fatalf("can't create column family error %v", err)
+		lsm.Close()
+		return
+	}
+	err = lsm.Set("root", "root")
+	if err == nil {
+		err = cf.Set("cf", "cf")
+	}
+	if err == nil {
+		err = cf.Flush()
+	}
+	if err != nil {
+		t.Fatalf("can't write column families error %v", err)
+		lsm.Close()
+		return
+	}
+
+	err = lsm.Backup(filepath.Join(rootPath, "backup"))
+	if err != nil {
+		t.Fatalf("can't backup lsm error %v", err)
+		lsm.Close()
+		return
+	}
+
+	for round := 1; round <= 3; round++ {
+		for _, key := range keys {
+			err = lsm.Set(key, strconv.Itoa(round))
+			if err != nil {
+				t.Fatalf("can't set lsm key error %v", err)
+				lsm.Close()
+				return
+			}
+		}
+	}
+	untilSeq := uint64(3*len(keys) + 2)
+
+	for _, key := range keys {
+		err = lsm.Set(key, "4")
+		if err != nil {
+			t.Fatalf("can't set lsm key error %v", err)
+			lsm.Close()
+			return
+		}
+	}
+	lsm.Close()
+
+	restorePath := filepath.Join(rootPath, "restore")
+	err = RestoreLsm(log, filepath.Join(rootPath, "backup"), opts.ArchivePath, restorePath, untilSeq, 0, opts)
+	if err != nil {
+		t.Fatalf("can't restore lsm error %v", err)
+		return
+	}
+
+	lsm, err = OpenLsm(log, restorePath)
+	if err != nil {
+		t.Fatalf("can't open restored lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	for _, key := range keys {
+		value, err := lsm.Get(key)
+		if err != nil {
+			t.Fatalf("can't get lsm key %s error %v", key, err)
+			return
+		}
+		if value != "2" {
+			t.Fatalf("key %s restored value %s expected 2", key, value)
+			return
+		}
+	}
+
+	value, err := lsm.Get("root")
+	if err != nil || value != "root" {
+		t.Fatalf("root value %s error %v", value, err)
+		return
+	}
+	cf, err = lsm.ColumnFamily("cf")
+	if err == nil {
+		value, err = cf.Get("cf")
+	}
+	if err != nil || value != "cf" {
+		t.Fatalf("column family value %s error %v", value, err)
+		return
+	}
+
+	// Without the older segments the records after the backup are gone
+	segmentIds, err := listFileIndexes(vfs.Default, opts.ArchivePath, archiveFileNamePattern)
+	if err != nil || len(segmentIds) < 2 {
+		t.Fatalf("segments %v error %v", segmentIds, err)
+		return
+	}
+	for _, id := range segmentIds[:len(segmentIds)-1] {
+		os.Remove(getArchiveSegmentPath(opts.ArchivePath, id))
+	}
+	err = RestoreLsm(log, filepath.Join(rootPath, "backup"), opts.ArchivePath,
+		filepath.Join(rootPath, "gap"), 0, 0, opts)
+	if !errors.Is(err, ErrRestoreGap) {
+		t.Fatalf("restore with a gap error %v", err)
+		return
+	}
+}
+
+func TestLsmArchivePrune(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	opts := DefaultLsmOptions()
+	opts.FS = vfs.NewMemFS()
+	opts.ArchiveLog = true
+	opts.ArchivePath = "/TestLsmArchivePruneArchive"
+
+	lsm, err := NewLsmWithOptions(log, "/TestLsmArchivePrune", opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	set := func(from int, to int) bool {
+		for i := from; i < to; i++ {
+			err := lsm.Set(fmt.Sprintf("key%04d", i), "value")
+			if err != nil {
+				t.Fatalf("can't set key error %v", err)
+				return false
+			}
+		}
+		return true
+	}
+	segments := func() int {
+		ids, err := listFileIndexes(opts.FS, opts.ArchivePath, archiveFileNamePattern)
+		if err != nil {
+			t.Fatalf("can't list archive error %v", err)
+			return -1
+		}
+		return len(ids)
+	}
+
+	// Each flush archives one segment
+	if !set(0, maxMemoryNodeCount) {
+		return
+	}
+	err = lsm.Backup("/TestLsmArchivePruneBackup")
+	if err != nil {
+		t.Fatalf("can't backup error %v", err)
+		return
+	}
+	if !set(maxMemoryNodeCount, 3*maxMemoryNodeCount) || segments() != 3 {
+		return
+	}
+
+	// Only the segment older than the backup goes
+	err = lsm.PruneArchive(maxMemoryNodeCount)
+	if err != nil || segments() != 2 {
+		t.Fatalf("prune error %v segments %d", err, segments())
+		return
+	}
+
+	err = RestoreLsm(log, "/TestLsmArchivePruneBackup", opts.ArchivePath, "/TestLsmArchivePruneRestore", 0, 0, opts)
+	if err != nil {
+		t.Fatalf("can't restore error %v", err)
+		return
+	}
+	restored, err := OpenLsmWithOptions(log, "/TestLsmArchivePruneRestore", opts)
+	if err != nil {
+		t.Fatalf("can't open restored lsm error %v", err)
+		return
+	}
+	for i := 0; i < 3*maxMemoryNodeCount; i++ {
+		_, err = restored.Get(fmt.Sprintf("key%04d", i))
+		if err != nil {
+			t.Fatalf("restored key %d error %v", i, err)
+			restored.Close()
+			return
+		}
+	}
+	restored.Close()
+
+	err = lsm.PruneArchive(lsm.seq)
+	if err != nil || segments() != 0 {
+		t.Fatalf("prune all error %v segments %d", err, segments())
+		return
+	}
+
+	// Segments past the retention go as the next one is archived
+	lsm.opts.ArchiveRetention = time.Nanosecond
+	if !set(0, maxMemoryNodeCount) || segments() != 0 {
+		t.Fatalf("segments past retention %d", segments())
+		return
+	}
+}
+
+func TestLsmVerifyRepair(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmVerifyRepair_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	dataPath := filepath.Join(rootPath, "data")
+	lsm, err := NewLsm(log, dataPath)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	for i := 0; i < maxMemoryNodeCount; i++ {
+		err = lsm.Set(fmt.Sprintf("key%04d", i), random.GenerateRandomHexString(16))
+		if err != nil {
+			t.Fatalf("can't set lsm key error %v", err)
+			lsm.Close()
+			return
+		}
+	}
+	lsm.Close()
+
+	reports, err := VerifyLsm(dataPath, DefaultLsmOptions())
+	if err != nil {
+		t.Fatalf("can't verify lsm error %v", err)
+		return
+	}
+	for _, r := range reports {
+		if !r.Ok() {
+			t.Fatalf("%s is corrupt %v", r.FilePath, r.Corrupt)
+			return
+		}
+	}
+
+	tablePath := reports[0].FilePath
+	f, err := os.OpenFile(tablePath, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("can't open table error %v", err)
+		return
+	}
+	// Second block holds the key of the first record
+	_, err = f.WriteAt([]byte{0xFF}, IoBlockSize)
+	f.Close()
+	if err != nil {
+		t.Fatalf("can't corrupt table error %v", err)
+		return
+	}
+
+	r, err := VerifyFile(tablePath, true, DefaultLsmOptions())
+	if err != nil {
+		t.Fatalf("can't verify table error %v", err)
+		return
+	}
+	// The rest of the corrupt record is not reported again
+	if len(r.Corrupt) != 1 || r.Corrupt[0].Offset != 0 || r.Corrupt[0].Err != ErrLsmNodeBadCheckSum {
+		t.Fatalf("unexpected corruption report %v", r.Corrupt)
+		return
+	}
+
+	repairPath := filepath.Join(rootPath, "repair")
+	err = RepairLsm(log, dataPath, repairPath, DefaultLsmOptions())
+	if err != nil {
+		t.Fatalf("can't repair lsm error %v", err)
+		return
+	}
+
+	lsm, err = OpenLsm(log, repairPath)
+	if err != nil {
+		t.Fatalf("can't open repaired lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	_, err = lsm.Get("key0000")
+	if err != ErrNotFound {
+		t.Fatalf("corrupt key lookup error %v", err)
+		return
+	}
+
+	for i := 1; i < maxMemoryNodeCount; i++ {
+		_, err = lsm.Get(fmt.Sprintf("key%04d", i))
+		if err != nil {
+			t.Fatalf("can't get salvaged key %d error %v", i, err)
+			return
+		}
+	}
+}
+
+func TestLsmRepairHistory(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	opts := DefaultLsmOptions()
+	opts.FS = vfs.NewMemFS()
+	opts.VersionRetention = time.Hour
+
+	rootPath := "/TestLsmRepairHistory"
+	lsm, err := NewLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	err = lsm.Set("key", "first")
+	ts := timestamp.GetTimestamp()
+	if err == nil {
+		err = lsm.Set("key", "second")
+	}
+	if err == nil {
+		err = lsm.Flush()
+	}
+	lsm.Close()
+	if err != nil {
+		t.Fatalf("can't write error %v", err)
+		return
+	}
+
+	repairPath := "/TestLsmRepairHistoryRepaired"
+	err = RepairLsm(log, rootPath, repairPath, opts)
+	if err != nil {
+		t.Fatalf("can't repair lsm error %v", err)
+		return
+	}
+
+	lsm, err = OpenLsmWithOptions(log, repairPath, opts)
+	if err != nil {
+		t.Fatalf("can't open repaired lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	value, err := lsm.GetAt("key", ts)
+	if err != nil || value != "first" {
+		t.Fatalf("repaired old value %s error %v", value, err)
+		return
+	}
+	value, err = lsm.Get("key")
+	if err != nil || value != "second" {
+		t.Fatalf("repaired value %s error %v", value, err)
+		return
+	}
+}
+
+func TestLsmIngestExternalFiles(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmIngestExternalFiles_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	filePath := filepath.Join(rootPath, "external.sstable")
+	w, err := NewSsTableWriter(filePath)
+	if err != nil {
+		t.Fatalf("can't create writer error %v", err)
+		return
+	}
+	for i := 0; i < 1000; i++ {
+		err = w.Set(fmt.Sprintf("key%04d", i), "ingested")
+		if err != nil {
+			t.Fatalf("can't add key error %v", err)
+			w.Abort()
+			return
+		}
+	}
+	err = w.Set("key0000", "ingested")
+	if err != ErrSsTableWriterUnsorted {
+		t.Fatalf("unsorted key error %v", err)
+		w.Abort()
+		return
+	}
+	err = w.Finish()
+	if err != nil {
+		t.Fatalf("can't finish writer error %v", err)
+		return
+	}
+
+	lsm, err := NewLsm(log, filepath.Join(rootPath, "data"))
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	err = lsm.Set("key0001", "old")
+	if err != nil {
+		t.Fatalf("can't set lsm key error %v", err)
+		return
+	}
+
+	begin := timestamp.GetTimestamp()
+	err = lsm.IngestExternalFiles([]string{filePath})
+	if err != nil {
+		t.Fatalf("can't ingest error %v", err)
+		return
+	}
+
+	// The ingested records are stamped as written after the set
+	ids := lsm.sortedSsTableIds()
+	st := lsm.ssTableMap[ids[len(ids)-1]]
+	if lsm.seq != 1001 || st.maxSeq != lsm.seq || st.minTimestamp < begin {
+		t.Fatalf("ingested seq %d timestamp %d, lsm seq %d", st.maxSeq, st.minTimestamp, lsm.seq)
+		return
+	}
+
+	err = lsm.Set("key0002", "new")
+	if err != nil {
+		t.Fatalf("can't set lsm key error %v", err)
+		return
+	}
+
+	for i := 0; i < 1000; i++ {
+		expected := "ingested"
+		if i == 2 {
+			expected = "new"
+		}
+		value, err := lsm.Get(fmt.Sprintf("key%04d", i))
+		if err != nil {
+			t.Fatalf("can't get key %d error %v", i, err)
+			return
+		}
+		if value != expected {
+			t.Fatalf("key %d value %s expected %s", i, value, expected)
+			return
+		}
+	}
+}
+
+func TestLsmCompactRange(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmCompactRange_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 300; i++ {
+		err = lsm.Set(fmt.Sprintf("key%04d", i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatalf("can't set lsm key error %v", err)
+			return
+		}
+	}
+
+	for i := 0; i < 300; i += 2 {
+		err = lsm.Delete(fmt.Sprintf("key%04d", i))
+		if err != nil {
+			t.Fatalf("can't delete lsm key error %v", err)
+			return
+		}
+	}
+
+	err = lsm.Flush()
+	if err != nil {
+		t.Fatalf("can't flush error %v", err)
+		return
+	}
+
+	err = lsm.CompactRange("key0100", "key0200")
+	if err != nil {
+		t.Fatalf("can't compact range error %v", err)
+		return
+	}
+
+	tombstones := 0
+	for _, st := range lsm.ssTableMap {
+		err = ScanFile(st.filePath, DefaultLsmOptions(), func(r *FileRecord) error {
+			if r.Deleted && r.Key < "key0200" {
+				tombstones++
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("can't scan table error %v", err)
+			return
+		}
+	}
+	if tombstones != 0 {
+		t.Fatalf("%d tombstones left", tombstones)
+		return
+	}
+
+	for i := 0; i < 300; i++ {
+		value, err := lsm.Get(fmt.Sprintf("key%04d", i))
+		if i%2 == 0 {
+			if err != ErrNotFound {
+				t.Fatalf("deleted key %d error %v", i, err)
+				return
+			}
+			continue
+		}
+		if err != nil || value != strconv.Itoa(i) {
+			t.Fatalf("key %d value %s error %v", i, value, err)
+			return
+		}
+	}
+}
+
+func TestLsmMergeDropsTombstones(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmMergeDropsTombstones_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	for round := 0; round < 9; round++ {
+		for i := 0; i < maxMemoryNodeCount; i++ {
+			key := fmt.Sprintf("key%04d", i)
+			if round%2 == 0 {
+				err = lsm.Set(key, strconv.Itoa(round))
+			} else {
+				err = lsm.Delete(key)
+			}
+			if err != nil {
+				t.Fatalf("can't update lsm key error %v", err)
+				return
+			}
+		}
+	}
+
+	err = lsm.WaitForMerges()
+	if err != nil {
+		t.Fatalf("can't wait for merges error %v", err)
+		return
+	}
+
+	// The oldest pair is merged first, the tombstones cancel every value
+	// and nothing older remains, so both tables must vanish
+	if len(lsm.ssTableMap) != maxSsTableCount-1 {
+		t.Fatalf("unexpected table count %d", len(lsm.ssTableMap))
+		return
+	}
+
+	for i := 0; i < maxMemoryNodeCount; i++ {
+		value, err := lsm.Get(fmt.Sprintf("key%04d", i))
+		if err != nil || value != "8" {
+			t.Fatalf("key %d value %s error %v", i, value, err)
+			return
+		}
+	}
+}
+
+func TestLsmMergeCrash(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	opts := DefaultLsmOptions()
+	opts.FS = fs
+
+	rootPath := "/TestLsmMergeCrash"
+	lsm, err := NewLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	// The newer table deletes a key of the older one, both are flushed
+	for i := 0; i < maxMemoryNodeCount; i++ {
+		err = lsm.Set(fmt.Sprintf("a%03d", i), "value")
+		if err != nil {
+			t.Fatalf("can't set key error %v", err)
+			lsm.Close()
+			return
+		}
+	}
+	err = lsm.Delete("a000")
+	for i := 1; err == nil && i < maxMemoryNodeCount; i++ {
+		err = lsm.Set(fmt.Sprintf("b%03d", i), "value")
+	}
+	if err != nil || len(lsm.ssTableMap) != 2 {
+		t.Fatalf("tables %d error %v", len(lsm.ssTableMap), err)
+		lsm.Close()
+		return
+	}
+
+	merge := func() error {
+		lsm.mergeLock.Lock()
+		defer lsm.mergeLock.Unlock()
+		lsm.ssTableMapLock.RLock()
+		ids := lsm.sortedSsTableIds()
+		lsm.ssTableMapLock.RUnlock()
+		return lsm.mergeSsTableRun(ids)
+	}
+
+	// The older input outlives the merge as it would a crash right after
+	// the output took the place of the newer one
+	fs.FailRemoves(0, syscall.EIO)
+	err = merge()
+	if !errors.Is(err, syscall.EIO) {
+		t.Fatalf("merge error %v", err)
+		lsm.Close()
+		return
+	}
+	lsm.Close()
+
+	fs.FailRemoves(0, nil)
+	err = fs.Crash()
+	if err != nil {
+		t.Fatalf("can't crash error %v", err)
+		return
+	}
+
+	lsm, err = OpenLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	check := func(stage string) bool {
+		_, err := lsm.Get("a000")
+		if err != ErrNotFound {
+			t.Fatalf("%s deleted key error %v", stage, err)
+			return false
+		}
+		for _, key := range []string{"a001", "b001"} {
+			value, err := lsm.Get(key)
+			if err != nil || value != "value" {
+				t.Fatalf("%s get %s value %s error %v", stage, key, value, err)
+				return false
+			}
+		}
+		return true
+	}
+
+	if len(lsm.ssTableMap) != 2 || !check("crash") {
+		return
+	}
+
+	// Once nothing older is left the tombstone goes
+	err = merge()
+	if err != nil {
+		t.Fatalf("can't merge error %v", err)
+		return
+	}
+	tables := lsm.Stats().Tables
+	if len(tables) != 1 || tables[0].TombstoneRatio != 0 {
+		t.Fatalf("tables after merge %+v", tables)
+		return
+	}
+	check("merge")
+}
+
+func TestLsmCompactRangeCrash(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	opts := DefaultLsmOptions()
+	opts.FS = fs
+
+	rootPath := "/TestLsmCompactRangeCrash"
+	lsm, err := NewLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	// The newer table deletes a key of the older one, both are flushed
+	for i := 0; i < maxMemoryNodeCount; i++ {
+		err = lsm.Set(fmt.Sprintf("a%03d", i), "value")
+		if err != nil {
+			t.Fatalf("can't set key error %v", err)
+			lsm.Close()
+			return
+		}
+	}
+	err = lsm.Delete("a000")
+	for i := 1; err == nil && i < maxMemoryNodeCount; i++ {
+		err = lsm.Set(fmt.Sprintf("b%03d", i), "value")
+	}
+	if err != nil || len(lsm.ssTableMap) != 2 {
+		t.Fatalf("tables %d error %v", len(lsm.ssTableMap), err)
+		lsm.Close()
+		return
+	}
+
+	// Only one input is erased as if a crash came right after it
+	fs.FailRemoves(1, syscall.EIO)
+	err = lsm.CompactRange("", "")
+	if err != nil {
+		t.Fatalf("can't compact range error %v", err)
+		lsm.Close()
+		return
+	}
+	lsm.Close()
+
+	fs.FailRemoves(0, nil)
+	err = fs.Crash()
+	if err != nil {
+		t.Fatalf("can't crash error %v", err)
+		return
+	}
+
+	lsm, err = OpenLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	_, err = lsm.Get("a000")
+	if err != ErrNotFound {
+		t.Fatalf("deleted key error %v", err)
+		return
+	}
+	for _, key := range []string{"a001", "b001"} {
+		value, err := lsm.Get(key)
+		if err != nil || value != "value" {
+			t.Fatalf("get %s value %s error %v", key, value, err)
+			return
+		}
+	}
+}
+
+func TestLsmStats(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmStats_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	for i := 0; i < maxMemoryNodeCount; i++ {
+		err = lsm.Set(fmt.Sprintf("key%04d", i), "value")
+		if err != nil {
+			t.Fatalf("can't set lsm key error %v", err)
+			return
+		}
+	}
+	err = lsm.Delete("key0000")
+	if err != nil {
+		t.Fatalf("can't delete lsm key error %v", err)
+		return
+	}
+	lsm.Get("key0000")
+	lsm.Get("key0001")
+
+	s := lsm.Stats()
+	if s.Puts != maxMemoryNodeCount || s.Deletes != 1 || s.Gets != 2 {
+		t.Fatalf("unexpected counters %+v", s)
+		return
+	}
+	if s.MemoryHits != 1 || s.TableProbes != 1 || s.Flushes != 1 {
+		t.Fatalf("unexpected counters %+v", s)
+		return
+	}
+	if len(s.Tables) != 1 || s.Tables[0].Count != maxMemoryNodeCount ||
+		s.Tables[0].MinKey != "key0000" || s.Tables[0].MaxKey != "key0099" ||
+		s.TableBytes != s.Tables[0].Size {
+		t.Fatalf("unexpected tables %+v", s.Tables)
+		return
+	}
+	if s.GetLatency.Count() != 2 || s.LogBytes == 0 {
+		t.Fatalf("unexpected latencies %+v", s)
+		return
+	}
+
+	// Only the newest latencies are kept
+	for i := 0; i < latencySamples; i++ {
+		lsm.Get("key0000")
+	}
+	if s.GetLatency.Count() != latencySamples || s.GetLatency.Get99P() == 0 {
+		t.Fatalf("get latencies %d", s.GetLatency.Count())
+		return
+	}
+}
+
+type testEventListener struct {
+	NopEventListener
+	flushes     []int64
+	compactions []CompactionInfo
+	deleted     []int64
+	// deletedBefore is how many tables were deleted when each compaction
+	// completed
+	deletedBefore []int
+}
+
+func (l *testEventListener) OnFlushCompleted(info FlushInfo) {
+	l.flushes = append(l.flushes, info.TableId)
+}
+
+func (l *testEventListener) OnCompactionCompleted(info CompactionInfo) {
+	l.compactions = append(l.compactions, info)
+	l.deletedBefore = append(l.deletedBefore, len(l.deleted))
+}
+
+func (l *testEventListener) OnTableDeleted(info TableInfo) {
+	l.deleted = append(l.deleted, info.TableId)
+}
+
+func TestLsmEventListener(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmEventListener_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	listener := new(testEventListener)
+	opts := DefaultLsmOptions()
+	opts.EventListener = listener
+	lsm, err := NewLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	for i := 0; i < (maxSsTableCount+1)*maxMemoryNodeCount; i++ {
+		err = lsm.Set(fmt.Sprintf("key%04d", i), "value")
+		if err != nil {
+			t.Fatalf("can't set lsm key error %v", err)
+			return
+		}
+	}
+
+	err = lsm.WaitForMerges()
+	if err != nil {
+		t.Fatalf("can't wait for merges error %v", err)
+		return
+	}
+
+	if len(listener.flushes) != maxSsTableCount+1 {
+		t.Fatalf("unexpected flushes %v", listener.flushes)
+		return
+	}
+
+	if len(listener.compactions) != 1 || len(listener.deleted) != 1 {
+		t.Fatalf("unexpected compactions %v deleted %v", listener.compactions, listener.deleted)
+		return
+	}
+
+	c := listener.compactions[0]
+	if len(c.Inputs) != 2 || len(c.Outputs) != 1 || c.Outputs[0] != c.Inputs[1] ||
+		listener.deleted[0] != c.Inputs[0] {
+		t.Fatalf("unexpected compaction %+v deleted %v", c, listener.deleted)
+		return
+	}
+
+	// The inputs of a range compaction are gone once it is reported
+	err = lsm.CompactRange("", "")
+	if err != nil {
+		t.Fatalf("can't compact error %v", err)
+		return
+	}
+	last := len(listener.compactions) - 1
+	c = listener.compactions[last]
+	deleted := make(map[int64]bool)
+	for _, id := range listener.deleted[:listener.deletedBefore[last]] {
+		deleted[id] = true
+	}
+	for _, id := range c.Inputs {
+		if !deleted[id] {
+			t.Fatalf("compaction %+v completed before input %d was deleted", c, id)
+			return
+		}
+	}
+}
+
+type mergeListener struct {
+	NopEventListener
+	begin     chan CompactionInfo
+	completed int32
+}
+
+func (l *mergeListener) OnCompactionBegin(info CompactionInfo) {
+	select {
+	case l.begin <- info:
+	default:
+	}
+}
+
+func (l *mergeListener) OnCompactionCompleted(info CompactionInfo) {
+	atomic.AddInt32(&l.completed, 1)
+}
+
+func TestLsmThrottledMerge(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	listener := &mergeListener{begin: make(chan CompactionInfo, 1)}
+	limiter := ratelimit.NewRateLimiter(0)
+	opts := DefaultLsmOptions()
+	opts.FS = vfs.NewMemFS()
+	opts.EventListener = listener
+	opts.RateLimiter = limiter
+	lsm, err := NewLsmWithOptions(log, "/TestLsmThrottledMerge", opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	setKeys := func(from int, count int) bool {
+		for i := from; i < from+count; i++ {
+			err := lsm.Set(fmt.Sprintf("key%04d", i), "value")
+			if err != nil {
+				t.Fatalf("can't set key error %v", err)
+				return false
+			}
+		}
+		return true
+	}
+
+	if !setKeys(0, maxSsTableCount*maxMemoryNodeCount) {
+		return
+	}
+
+	// The next flush starts a merge which takes over a second at this rate
+	limiter.SetRate(200000)
+	keyCount := (maxSsTableCount + 1) * maxMemoryNodeCount
+	if !setKeys(maxSsTableCount*maxMemoryNodeCount, maxMemoryNodeCount) {
+		return
+	}
+
+	select {
+	case <-listener.begin:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("merge did not start")
+		return
+	}
+
+	// Reads and writes go on while the merge waits for the rate limiter
+	// and the flush goes first
+	value, err := lsm.Get("key0000")
+	if err != nil || value != "value" {
+		t.Fatalf("get value %s error %v", value, err)
+		return
+	}
+	if !setKeys(keyCount, maxMemoryNodeCount) {
+		return
+	}
+	keyCount += maxMemoryNodeCount
+	if n := atomic.LoadInt32(&listener.completed); n != 0 {
+		t.Fatalf("%d merges completed before the flush", n)
+		return
+	}
+
+	limiter.SetRate(0)
+	err = lsm.WaitForMerges()
+	if err != nil {
+		t.Fatalf("can't wait for merges error %v", err)
+		return
+	}
+
+	if n := len(lsm.Stats().Tables); n != maxSsTableCount {
+		t.Fatalf("table count %d", n)
+		return
+	}
+	for i := 0; i < keyCount; i++ {
+		value, err := lsm.Get(fmt.Sprintf("key%04d", i))
+		if err != nil || value != "value" {
+			t.Fatalf("get key %d value %s error %v", i, value, err)
+			return
+		}
+	}
+}
+
+func TestLsmDirectoryLock(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmDirectoryLock_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	_, err = OpenLsm(log, rootPath)
+	if err != ErrLsmLocked {
+		t.Fatalf("open of locked lsm error %v", err)
+		lsm.Close()
+		return
+	}
+	lsm.Close()
+
+	lsm, err = OpenLsm(log, rootPath)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	lsm.Close()
+}
+
+func TestLsmReadOnlySecondary(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmReadOnlySecondary_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	for i := 0; i < 150; i++ {
+		err = lsm.Set(fmt.Sprintf("key%04d", i), "first")
+		if err != nil {
+			t.Fatalf("can't set lsm key error %v", err)
+			lsm.Close()
+			return
+		}
+	}
+
+	_, err = OpenLsmReadOnly(log, rootPath, DefaultLsmOptions())
+	if err != ErrLsmLocked {
+		t.Fatalf("read only open of live lsm error %v", err)
+		lsm.Close()
+		return
+	}
+
+	secondary, err := OpenLsmSecondary(log, rootPath, DefaultLsmOptions())
+	if err != nil {
+		t.Fatalf("can't open secondary error %v", err)
+		lsm.Close()
+		return
+	}
+	defer secondary.Close()
+
+	for i := 0; i < 150; i++ {
+		value, err := secondary.Get(fmt.Sprintf("key%04d", i))
+		if err != nil || value != "first" {
+			t.Fatalf("secondary key %d value %s error %v", i, value, err)
+			lsm.Close()
+			return
+		}
+	}
+
+	if secondary.Set("key0000", "value") != ErrReadOnly {
+		t.Fatalf("secondary accepted a write")
+		lsm.Close()
+		return
+	}
+
+	for i := 0; i < 150; i++ {
+		err = lsm.Set(fmt.Sprintf("key%04d", i), "second")
+		if err != nil {
+			t.Fatalf("can't set lsm key error %v", err)
+			lsm.Close()
+			return
+		}
+	}
+	lsm.Close()
+
+	err = secondary.TryCatchUpWithPrimary()
+	if err != nil {
+		t.Fatalf("can't catch up error %v", err)
+		return
+	}
+
+	for i := 0; i < 150; i++ {
+		value, err := secondary.Get(fmt.Sprintf("key%04d", i))
+		if err != nil || value != "second" {
+			t.Fatalf("secondary key %d value %s error %v", i, value, err)
+			return
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(rootPath, logFileName))
+	if err != nil {
+		t.Fatalf("can't stat log error %v", err)
+		return
+	}
+
+	// A directory without a LOCK file is still locked against a primary
+	err = os.Remove(filepath.Join(rootPath, lockFileName))
+	if err != nil {
+		t.Fatalf("can't remove lock file error %v", err)
+		return
+	}
+
+	readOnly, err := OpenLsmReadOnly(log, rootPath, DefaultLsmOptions())
+	if err != nil {
+		t.Fatalf("can't open read only error %v", err)
+		return
+	}
+	_, err = OpenLsm(log, rootPath)
+	if err != ErrLsmLocked {
+		t.Fatalf("open of read lsm error %v", err)
+		readOnly.Close()
+		return
+	}
+	value, err := readOnly.Get("key0149")
+	readOnly.Close()
+	if err != nil || value != "second" {
+		t.Fatalf("read only value %s error %v", value, err)
+		return
+	}
+
+	newInfo, err := os.Stat(filepath.Join(rootPath, logFileName))
+	if err != nil || newInfo.Size() != info.Size() || newInfo.ModTime() != info.ModTime() {
+		t.Fatalf("read only open changed the log error %v", err)
+		return
+	}
+}
+
+func TestLsmSecondaryBadLog(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	opts := DefaultLsmOptions()
+	opts.FS = fs
+
+	rootPath := "/TestLsmSecondaryBadLog"
+	lsm, err := NewLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	err = lsm.Set("key0", "value")
+	if err != nil {
+		t.Fatalf("can't set key error %v", err)
+		return
+	}
+
+	secondary, err := OpenLsmSecondary(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't open secondary error %v", err)
+		return
+	}
+	defer secondary.Close()
+
+	offset := lsm.logSize
+	err = lsm.Set("key1", "value")
+	if err != nil {
+		t.Fatalf("can't set key error %v", err)
+		return
+	}
+
+	// A corrupt record fails the catch up and the last view is kept
+	err = fs.FlipBit(filepath.Join(rootPath, logFileName), offset, 0)
+	if err != nil {
+		t.Fatalf("can't flip bit error %v", err)
+		return
+	}
+	err = secondary.TryCatchUpWithPrimary()
+	if err == nil {
+		t.Fatalf("catch up over a corrupt log succeeded")
+		return
+	}
+
+	value, err := secondary.Get("key0")
+	if err != nil || value != "value" {
+		t.Fatalf("secondary value %s error %v", value, err)
+		return
+	}
+}
+
+func TestLsmCrashConsistency(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	opts := DefaultLsmOptions()
+	opts.FS = fs
+	opts.Sync = true
+
+	rootPath := "/TestLsmCrashConsistency"
+	lsm, err := NewLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	// The log survives a crash before the first flush
+	err = lsm.Set("first", "value")
+	if err == nil {
+		err = fs.Crash()
+	}
+	lsm.Close()
+	if err != nil {
+		t.Fatalf("can't set key and crash error %v", err)
+		return
+	}
+	lsm, err = OpenLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't open new lsm error %v", err)
+		return
+	}
+	value, err := lsm.Get("first")
+	if err != nil || value != "value" {
+		t.Fatalf("first value %s error %v", value, err)
+		lsm.Close()
+		return
+	}
+
+	keyCount := 5 * maxMemoryNodeCount / 2
+	for i := 0; i < keyCount; i++ {
+		err = lsm.Set(fmt.Sprintf("key%04d", i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatalf("can't set key error %v", err)
+			lsm.Close()
+			return
+		}
+	}
+
+	err = fs.Crash()
+	if err != nil {
+		t.Fatalf("can't crash error %v", err)
+		lsm.Close()
+		return
+	}
+	lsm.Close()
+
+	opts.Sync = false
+	lsm, err = OpenLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+
+	for i := 0; i < keyCount; i++ {
+		value, err := lsm.Get(fmt.Sprintf("key%04d", i))
+		if err != nil || value != strconv.Itoa(i) {
+			t.Fatalf("synced key %d lost value %s error %v", i, value, err)
+			lsm.Close()
+			return
+		}
+	}
+
+	// Few enough to stay in memory, they only reach the unsynced log
+	for i := 0; i < 10; i++ {
+		err = lsm.Set(fmt.Sprintf("lost%04d", i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatalf("can't set key error %v", err)
+			lsm.Close()
+			return
+		}
+	}
+
+	err = fs.Crash()
+	if err != nil {
+		t.Fatalf("can't crash error %v", err)
+		lsm.Close()
+		return
+	}
+	lsm.Close()
+
+	lsm, err = OpenLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	_, err = lsm.Get("lost0000")
+	if err != ErrNotFound {
+		t.Fatalf("unsynced key survived crash error %v", err)
+		return
+	}
+
+	_, err = lsm.Get(fmt.Sprintf("key%04d", keyCount-1))
+	if err != nil {
+		t.Fatalf("synced key lost error %v", err)
+		return
+	}
+}
+
+func TestLsmSyncFailure(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	opts := DefaultLsmOptions()
+	opts.FS = fs
+	opts.Sync = true
+	rootPath := "/TestLsmSyncFailure"
+	lsm, err := NewLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	err = lsm.Set("key0", "value")
+	if err != nil {
+		t.Fatalf("can't set key error %v", err)
+		lsm.Close()
+		return
+	}
+
+	// Writes which fail to sync are taken out of the log
+	fs.FailSyncs(syscall.EIO)
+	err = lsm.Set("lost0", "value")
+	if !errors.Is(err, syscall.EIO) {
+		t.Fatalf("set error %v", err)
+		lsm.Close()
+		return
+	}
+	b := NewWriteBatch()
+	b.Set("lost1", "value")
+	b.Set("lost2", "value")
+	err = lsm.Write(b)
+	if !errors.Is(err, syscall.EIO) {
+		t.Fatalf("write error %v", err)
+		lsm.Close()
+		return
+	}
+	fs.FailSyncs(nil)
+
+	err = lsm.Set("key1", "value")
+	lsm.Close()
+	if err != nil {
+		t.Fatalf("can't set key error %v", err)
+		return
+	}
+
+	lsm, err = OpenLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	for _, key := range []string{"lost0", "lost1", "lost2"} {
+		_, err = lsm.Get(key)
+		if err != ErrNotFound {
+			t.Fatalf("failed write of %s came back error %v", key, err)
+			return
+		}
+	}
+	for _, key := range []string{"key0", "key1"} {
+		_, err = lsm.Get(key)
+		if err != nil {
+			t.Fatalf("can't get %s error %v", key, err)
+			return
+		}
+	}
+	if lsm.seq != 2 {
+		t.Fatalf("seq %d", lsm.seq)
+		return
+	}
+}
+
+func TestLsmSubscribe(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	opts := DefaultLsmOptions()
+	opts.FS = vfs.NewMemFS()
+	opts.ArchiveLog = true
+	lsm, err := NewLsmWithOptions(log, "/TestLsmSubscribe", opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	live, err := lsm.Subscribe(0)
+	if err != nil {
+		t.Fatalf("can't subscribe error %v", err)
+		return
+	}
+	defer live.Close()
+
+	// Enough to flush several times and to overflow the live queue
+	keyCount := 2 * maxSubscriptionBacklog
+	for i := 0; i < keyCount; i++ {
+		err = lsm.Set(fmt.Sprintf("key%04d", i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatalf("can't set key error %v", err)
+			return
+		}
+	}
+	err = lsm.Delete("key0000")
+	if err != nil {
+		t.Fatalf("can't delete key error %v", err)
+		return
+	}
+
+	replay, err := lsm.Subscribe(1)
+	if err != nil {
+		t.Fatalf("can't subscribe error %v", err)
+		return
+	}
+	defer replay.Close()
+
+	for _, sub := range []*Subscription{live, replay} {
+		for i := 0; i < keyCount; i++ {
+			ev, err := sub.Next()
+			if err != nil {
+				t.Fatalf("can't get event %d error %v", i, err)
+				return
+			}
+			if ev.Seq != uint64(i+1) || ev.Key != fmt.Sprintf("key%04d", i) ||
+				ev.Value != strconv.Itoa(i) || ev.Deleted {
+				t.Fatalf("unexpected event %d %+v", i, ev)
+				return
+			}
+		}
+
+		ev, err := sub.Next()
+		if err != nil || !ev.Deleted || ev.Key != "key0000" {
+			t.Fatalf("unexpected delete event %+v error %v", ev, err)
+			return
+		}
+	}
+
+	replay.Close()
+	_, err = replay.Next()
+	if err != ErrSubscriptionClosed {
+		t.Fatalf("next on closed subscription error %v", err)
+		return
+	}
+
+	opts = DefaultLsmOptions()
+	opts.FS = vfs.NewMemFS()
+	lsm2, err := NewLsmWithOptions(log, "/TestLsmSubscribe", opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm2.Close()
+
+	for i := 0; i < 3*maxMemoryNodeCount/2; i++ {
+		err = lsm2.Set(fmt.Sprintf("key%04d", i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatalf("can't set key error %v", err)
+			return
+		}
+	}
+
+	// Without archiving only records which are not flushed are retained
+	_, err = lsm2.Subscribe(1)
+	if err != ErrSequenceNotRetained {
+		t.Fatalf("subscribe to flushed sequence error %v", err)
+		return
+	}
+
+	sub, err := lsm2.Subscribe(maxMemoryNodeCount + 1)
+	if err != nil {
+		t.Fatalf("can't subscribe error %v", err)
+		return
+	}
+	defer sub.Close()
+
+	ev, err := sub.Next()
+	if err != nil || ev.Seq != maxMemoryNodeCount+1 {
+		t.Fatalf("unexpected event %+v error %v", ev, err)
+		return
+	}
+}
+
+func TestLsmColumnFamilies(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	opts := DefaultLsmOptions()
+	opts.FS = fs
+	opts.Sync = true
+
+	rootPath := "/TestLsmColumnFamilies"
+	lsm, err := NewLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	meta, err := lsm.CreateColumnFamily("meta", nil)
+	if err != nil {
+		t.Fatalf("can't create column family error %v", err)
+		lsm.Close()
+		return
+	}
+
+	blobs, err := lsm.CreateColumnFamily("blobs", nil)
+	if err != nil {
+		t.Fatalf("can't create column family error %v", err)
+		lsm.Close()
+		return
+	}
+
+	_, err = lsm.CreateColumnFamily("meta", nil)
+	if err != ErrColumnFamilyExists {
+		t.Fatalf("create of existing column family error %v", err)
+		lsm.Close()
+		return
+	}
+
+	// Enough to flush every family and leave some records in the log
+	keyCount := 5 * maxMemoryNodeCount / 2
+	for i := 0; i < keyCount; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		b := NewWriteBatch()
+		b.Set(key, "default"+strconv.Itoa(i))
+		b.SetCF(meta, key, "meta"+strconv.Itoa(i))
+		b.SetCF(blobs, key, "blobs"+strconv.Itoa(i))
+		err = lsm.Write(b)
+		if err != nil {
+			t.Fatalf("can't write batch error %v", err)
+			lsm.Close()
+			return
+		}
+	}
+
+	err = meta.Delete("key0000")
+	if err != nil {
+		t.Fatalf("can't delete key error %v", err)
+		lsm.Close()
+		return
+	}
+
+	// A batch with a torn tail must vanish as a whole
+	fs.FailWrites(4, fmt.Errorf("injected"))
+	b := NewWriteBatch()
+	b.Set("torn", "value")
+	b.SetCF(meta, "torn", "value")
+	err = lsm.Write(b)
+	fs.FailWrites(0, nil)
+	if err == nil {
+		t.Fatalf("torn batch written")
+		lsm.Close()
+		return
+	}
+
+	err = lsm.DropColumnFamily("blobs")
+	if err != nil {
+		t.Fatalf("can't drop column family error %v", err)
+		lsm.Close()
+		return
+	}
+	lsm.Close()
+
+	lsm, err = OpenLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	names := lsm.ColumnFamilies()
+	if len(names) != 1 || names[0] != "meta" {
+		t.Fatalf("unexpected column families %v", names)
+		return
+	}
+
+	_, err = lsm.ColumnFamily("blobs")
+	if err != ErrColumnFamilyNotFound {
+		t.Fatalf("lookup of dropped column family error %v", err)
+		return
+	}
+
+	meta, err = lsm.ColumnFamily("meta")
+	if err != nil {
+		t.Fatalf("can't find column family error %v", err)
+		return
+	}
+
+	for i := 1; i < keyCount; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		value, err := lsm.Get(key)
+		if err != nil || value != "default"+strconv.Itoa(i) {
+			t.Fatalf("default key %s value %s error %v", key, value, err)
+			return
+		}
+		value, err = meta.Get(key)
+		if err != nil || value != "meta"+strconv.Itoa(i) {
+			t.Fatalf("meta key %s value %s error %v", key, value, err)
+			return
+		}
+	}
+
+	_, err = meta.Get("key0000")
+	if err != ErrNotFound {
+		t.Fatalf("deleted key error %v", err)
+		return
+	}
+
+	_, err = lsm.Get("torn")
+	if err != ErrNotFound {
+		t.Fatalf("torn batch key error %v", err)
+		return
+	}
+}
+
+func TestLsmColumnFamilyReopen(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	fs := vfs.NewMemFS()
+	opts := DefaultLsmOptions()
+	opts.FS = fs
+	opts.VersionRetention = time.Hour
+
+	rootPath := "/TestLsmColumnFamilyReopen"
+	logPath := filepath.Join(rootPath, logFileName)
+	lsm, err := NewLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	cf, err := lsm.CreateColumnFamily("cf", nil)
+	if err == nil {
+		err = lsm.Set("root", "1")
+	}
+	if err == nil {
+		err = cf.Set("key", "1")
+	}
+	if err == nil {
+		err = cf.Flush()
+	}
+	lsm.Close()
+	if err != nil {
+		t.Fatalf("can't write column families error %v", err)
+		return
+	}
+
+	open := func() bool {
+		lsm, err = OpenLsmWithOptions(log, rootPath, opts)
+		if err != nil {
+			t.Fatalf("can't open lsm error %v", err)
+			return false
+		}
+		cf, err = lsm.ColumnFamily("cf")
+		if err != nil {
+			lsm.Close()
+			t.Fatalf("can't find column family error %v", err)
+			return false
+		}
+		return true
+	}
+
+	// The family flush left its record in the log, it is not replayed
+	for i := 0; i < 2; i++ {
+		if !open() {
+			return
+		}
+		err = cf.Flush()
+		memoryNodes := len(lsm.nodeMap)
+		tables := len(cf.Stats().Tables)
+		lsm.Close()
+		if err != nil || memoryNodes != 1 || tables != 1 {
+			t.Fatalf("memory nodes %d family tables %d error %v", memoryNodes, tables, err)
+			return
+		}
+	}
+
+	// A crash between a flush and the rotation of the log leaves every
+	// record in it
+	if !open() {
+		return
+	}
+	err = copyFile(fs, logPath, "/saved.log")
+	if err == nil {
+		err = lsm.Flush()
+	}
+	lsm.Close()
+	if err == nil {
+		err = fs.Remove(logPath)
+	}
+	if err == nil {
+		err = copyFile(fs, "/saved.log", logPath)
+	}
+	if err != nil {
+		t.Fatalf("can't replace log error %v", err)
+		return
+	}
+
+	if !open() {
+		return
+	}
+	defer lsm.Close()
+
+	if len(lsm.nodeMap) != 0 || len(cf.lsm.nodeMap) != 0 {
+		t.Fatalf("memory nodes %d family %d", len(lsm.nodeMap), len(cf.lsm.nodeMap))
+		return
+	}
+	value, err := lsm.Get("root")
+	if err != nil || value != "1" {
+		t.Fatalf("root value %s error %v", value, err)
+		return
+	}
+	value, err = cf.Get("key")
+	if err != nil || value != "1" {
+		t.Fatalf("family value %s error %v", value, err)
+		return
+	}
+}
+
+func TestLsmApproximateSize(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmApproximateSize_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	keyCount := 8 * keysPerIndex
+	filePath := filepath.Join(rootPath, "external.sstable")
+	w, err := NewSsTableWriter(filePath)
+	if err != nil {
+		t.Fatalf("can't create writer error %v", err)
+		return
+	}
+	for i := 0; i < keyCount; i++ {
+		err = w.Set(fmt.Sprintf("key%05d", i), "value")
+		if err != nil {
+			t.Fatalf("can't add key error %v", err)
+			w.Abort()
+			return
+		}
+	}
+	err = w.Finish()
+	if err != nil {
+		t.Fatalf("can't finish writer error %v", err)
+		return
+	}
+
+	lsm, err := NewLsm(log, filepath.Join(rootPath, "data"))
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	err = lsm.IngestExternalFiles([]string{filePath})
+	if err != nil {
+		t.Fatalf("can't ingest error %v", err)
+		return
+	}
+
+	count := lsm.ApproximateCount("", "")
+	if count != int64(keyCount) {
+		t.Fatalf("count of all keys %d", count)
+		return
+	}
+
+	nodeSize := newLsmNode("key00000", "value").diskSize()
+	if lsm.ApproximateSize("", "") != int64(keyCount)*nodeSize {
+		t.Fatalf("size of all keys %d", lsm.ApproximateSize("", ""))
+		return
+	}
+
+	// A quarter of the keys, estimates are good to an index block
+	start, end := fmt.Sprintf("key%05d", keyCount/4), fmt.Sprintf("key%05d", keyCount/2)
+	count = lsm.ApproximateCount(start, end)
+	if count < int64(keyCount/4-keysPerIndex) || count > int64(keyCount/4+keysPerIndex) {
+		t.Fatalf("count of quarter %d", count)
+		return
+	}
+
+	size := lsm.ApproximateSize(start, end)
+	if size < int64(keyCount/4-keysPerIndex)*nodeSize || size > int64(keyCount/4+keysPerIndex)*nodeSize {
+		t.Fatalf("size of quarter %d", size)
+		return
+	}
+
+	if lsm.ApproximateCount("a", "b") != 0 || lsm.ApproximateSize("zzz", "") != 0 {
+		t.Fatalf("nonzero estimate outside of keys")
+		return
+	}
+
+	for i := 0; i < 10; i++ {
+		err = lsm.Set(fmt.Sprintf("new%02d", i), "value")
+		if err != nil {
+			t.Fatalf("can't set key error %v", err)
+			return
+		}
+	}
+
+	count = lsm.ApproximateCount("new", "newz")
+	if count != 10 {
+		t.Fatalf("count of memory keys %d", count)
+		return
+	}
+}
+
+func TestLsmApproximateVersions(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	fs := vfs.NewMemFS()
+	opts := DefaultLsmOptions()
+	opts.FS = fs
+	opts.VersionRetention = time.Hour
+
+	lsm, err := NewLsmWithOptions(log, "/TestLsmApproximateVersions", opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	// Every key keeps two index blocks worth of versions, so each block
+	// of the table holds twice keysPerIndex records
+	keyCount, versionCount := 8, 2*keysPerIndex
+	for v := 0; v < versionCount; v++ {
+		for i := 0; i < keyCount; i++ {
+			err = lsm.Set(fmt.Sprintf("key%05d", i), fmt.Sprintf("value%d", v))
+			if err != nil {
+				t.Fatalf("can't set key error %v", err)
+				return
+			}
+		}
+	}
+	err = lsm.Flush()
+	if err != nil {
+		t.Fatalf("can't flush error %v", err)
+		return
+	}
+
+	total := int64(keyCount * versionCount)
+	if lsm.ApproximateCount("", "") != total {
+		t.Fatalf("count of all versions %d", lsm.ApproximateCount("", ""))
+		return
+	}
+
+	// Half of the keys, estimates are good to an index block
+	count := lsm.ApproximateCount("", fmt.Sprintf("key%05d", keyCount/2))
+	if count < total/2-int64(versionCount) || count > total/2+int64(versionCount) {
+		t.Fatalf("count of half %d", count)
+		return
+	}
+	size := lsm.ApproximateSize(fmt.Sprintf("key%05d", keyCount/2), "")
+	all := lsm.ApproximateSize("", "")
+	if size < all/2-all/int64(keyCount) || size > all/2+all/int64(keyCount) {
+		t.Fatalf("size of half %d of %d", size, all)
+		return
+	}
+}
+
+func TestLsmEncryption(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmEncryption_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	keyPath := filepath.Join(rootPath, "keys")
+	dataPath := filepath.Join(rootPath, "data")
+	err = os.MkdirAll(keyPath, 0700)
+	if err != nil {
+		t.Fatalf("can't create key dir error %v", err)
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(keyPath, "key1"), []byte(random.GenerateRandomHexString(32)), 0600)
+	if err != nil {
+		t.Fatalf("can't write key error %v", err)
+		return
+	}
+
+	opts := DefaultLsmOptions()
+	opts.KeyProvider = NewFileKeyProvider(keyPath)
+	lsm, err := NewLsmWithOptions(log, dataPath, opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	keyCount := 5 * maxMemoryNodeCount / 2
+	for i := 0; i < keyCount; i++ {
+		err = lsm.Set(fmt.Sprintf("key%03d", i), fmt.Sprintf("secret%03d", i))
+		if err != nil {
+			t.Fatalf("can't set key error %v", err)
+			lsm.Close()
+			return
+		}
+	}
+	lsm.Close()
+
+	infos, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		t.Fatalf("can't read dir error %v", err)
+		return
+	}
+	for _, info := range infos {
+		data, err := ioutil.ReadFile(filepath.Join(dataPath, info.Name()))
+		if err != nil {
+			t.Fatalf("can't read file error %v", err)
+			return
+		}
+		if strings.Contains(string(data), "secret") || strings.Contains(string(data), "key0") {
+			t.Fatalf("plain text in %s", info.Name())
+			return
+		}
+	}
+
+	_, err = OpenLsm(log, dataPath)
+	if err != ErrNoKeyProvider {
+		t.Fatalf("open without key provider error %v", err)
+		return
+	}
+
+	// The offline tools read and write encrypted files given the provider
+	_, err = VerifyLsm(dataPath, DefaultLsmOptions())
+	if err != ErrNoKeyProvider {
+		t.Fatalf("verify without key provider error %v", err)
+		return
+	}
+	reports, err := VerifyLsm(dataPath, opts)
+	if err != nil {
+		t.Fatalf("can't verify error %v", err)
+		return
+	}
+	records := int64(0)
+	for _, r := range reports {
+		if !r.Ok() {
+			t.Fatalf("verify %s corrupt %v", r.FilePath, r.Corrupt)
+			return
+		}
+		records += r.Records
+	}
+	if records != int64(keyCount) {
+		t.Fatalf("verify records %d", records)
+		return
+	}
+
+	repairPath := filepath.Join(rootPath, "repair")
+	err = RepairLsm(log, dataPath, repairPath, opts)
+	if err != nil {
+		t.Fatalf("can't repair error %v", err)
+		return
+	}
+	repaired, err := OpenLsmWithOptions(log, repairPath, opts)
+	if err != nil {
+		t.Fatalf("can't open repaired lsm error %v", err)
+		return
+	}
+	value, err := repaired.Get(fmt.Sprintf("key%03d", keyCount-1))
+	repaired.Close()
+	if err != nil || value != fmt.Sprintf("secret%03d", keyCount-1) {
+		t.Fatalf("repaired value %s error %v", value, err)
+		return
+	}
+
+	// A plain text record can't be slipped into an encrypted file
+	logPath := filepath.Join(repairPath, logFileName)
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("can't open log error %v", err)
+		return
+	}
+	err = newLsmNode("injected", "value").WriteTo(logFile)
+	logFile.Close()
+	if err != nil {
+		t.Fatalf("can't append to log error %v", err)
+		return
+	}
+	r, err := VerifyFile(logPath, false, opts)
+	if err != nil || len(r.Corrupt) != 1 || r.Corrupt[0].Err != ErrLsmNodeNotSealed {
+		t.Fatalf("verify log with plain text record %+v error %v", r, err)
+		return
+	}
+
+	// nor can sealed records be reordered
+	ids, err := listFileIndexes(vfs.Default, repairPath, ssTableFileNamePattern)
+	if err != nil || len(ids) == 0 {
+		t.Fatalf("tables %v error %v", ids, err)
+		return
+	}
+	tablePath := getSsTablePathIn(repairPath, ids[0])
+	data, err := ioutil.ReadFile(tablePath)
+	if err != nil {
+		t.Fatalf("can't read table error %v", err)
+		return
+	}
+	first := append([]byte{}, data[IoBlockSize:2*IoBlockSize]...)
+	copy(data[IoBlockSize:], data[2*IoBlockSize:3*IoBlockSize])
+	copy(data[2*IoBlockSize:], first)
+	err = ioutil.WriteFile(tablePath, data, 0600)
+	if err != nil {
+		t.Fatalf("can't write table error %v", err)
+		return
+	}
+	r, err = VerifyFile(tablePath, true, opts)
+	if err != nil || len(r.Corrupt) == 0 || r.Corrupt[0].Err != ErrLsmNodeBadSeal {
+		t.Fatalf("verify table with swapped records %+v error %v", r, err)
+		return
+	}
+
+	// Rotate the master key, compaction moves every table to the new one
+	err = ioutil.WriteFile(filepath.Join(keyPath, "key2"), []byte(random.GenerateRandomHexString(32)), 0600)
+	if err != nil {
+		t.Fatalf("can't write key error %v", err)
+		return
+	}
+
+	lsm, err = OpenLsmWithOptions(log, dataPath, opts)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	err = lsm.CompactRange("", "")
+	if err != nil {
+		t.Fatalf("can't compact error %v", err)
+		lsm.Close()
+		return
+	}
+	for _, ts := range lsm.Stats().Tables {
+		if ts.KeyId != "key2" {
+			t.Fatalf("table %d key id %s", ts.Id, ts.KeyId)
+			lsm.Close()
+			return
+		}
+	}
+	lsm.Close()
+
+	err = os.Remove(filepath.Join(keyPath, "key1"))
+	if err != nil {
+		t.Fatalf("can't remove key error %v", err)
+		return
+	}
+
+	lsm, err = OpenLsmWithOptions(log, dataPath, opts)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	for i := 0; i < keyCount; i++ {
+		value, err := lsm.Get(fmt.Sprintf("key%03d", i))
+		if err != nil || value != fmt.Sprintf("secret%03d", i) {
+			t.Fatalf("get key %d value %s error %v", i, value, err)
+			return
+		}
+	}
+}
+
+func TestLsmCorruptRecords(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	opts := DefaultLsmOptions()
+	opts.FS = fs
+	opts.MaxKeySize = 16
+	opts.MaxValueSize = 1024
+
+	rootPath := "/TestLsmCorruptRecords"
+	lsm, err := NewLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	err = lsm.Set(strings.Repeat("k", 17), "value")
+	if err != ErrKeyTooLarge {
+		t.Fatalf("set of large key error %v", err)
+		lsm.Close()
+		return
+	}
+	err = lsm.Set("key", strings.Repeat("v", 1025))
+	if err != ErrValueTooLarge {
+		t.Fatalf("set of large value error %v", err)
+		lsm.Close()
+		return
+	}
+
+	for i := 0; i < 10; i++ {
+		err = lsm.Set(fmt.Sprintf("key%02d", i), "value")
+		if err != nil {
+			t.Fatalf("can't set key error %v", err)
+			lsm.Close()
+			return
+		}
+	}
+	err = lsm.Flush()
+	if err != nil {
+		t.Fatalf("can't flush error %v", err)
+		lsm.Close()
+		return
+	}
+
+	// Three records stay in the log, the last one gets torn
+	for i := 10; i < 13; i++ {
+		err = lsm.Set(fmt.Sprintf("key%02d", i), "value")
+		if err != nil {
+			t.Fatalf("can't set key error %v", err)
+			lsm.Close()
+			return
+		}
+	}
+	tablePath := lsm.getSsTablePath(lsm.Stats().Tables[0].Id)
+	lsm.Close()
+
+	logPath := filepath.Join(rootPath, logFileName)
+	info, err := fs.Stat(logPath)
+	if err != nil {
+		t.Fatalf("can't stat log error %v", err)
+		return
+	}
+	logFile, err := fs.OpenFile(logPath, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("can't open log error %v", err)
+		return
+	}
+	err = logFile.Truncate(info.Size() - IoBlockSize)
+	logFile.Close()
+	if err != nil {
+		t.Fatalf("can't truncate log error %v", err)
+		return
+	}
+
+	lsm, err = OpenLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't open lsm with torn log error %v", err)
+		return
+	}
+	_, err = lsm.Get("key11")
+	if err != nil {
+		t.Fatalf("can't get key error %v", err)
+		lsm.Close()
+		return
+	}
+	_, err = lsm.Get("key12")
+	if err != ErrNotFound {
+		t.Fatalf("get of torn key error %v", err)
+		lsm.Close()
+		return
+	}
+	lsm.Close()
+
+	// Make the value length of the first table record huge
+	err = fs.FlipBit(tablePath, 15, 7)
+	if err != nil {
+		t.Fatalf("can't flip bit error %v", err)
+		return
+	}
+
+	_, err = OpenLsmWithOptions(log, rootPath, opts)
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) || corruption.FilePath != tablePath || corruption.Offset != 0 ||
+		corruption.Err != ErrLsmNodeTooLarge {
+		t.Fatalf("open of corrupt table error %v", err)
+		return
+	}
+}
+
+func TestLsmTieredStorage(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	tableSize := maxMemoryNodeCount * newLsmNode("key0000", "value").diskSize()
+	opts := DefaultLsmOptions()
+	opts.FS = vfs.NewMemFS()
+	opts.DataPaths = []DataPath{{Path: "/fast", TargetSize: 2 * tableSize}, {Path: "/slow"}}
+
+	rootPath := "/TestLsmTieredStorage"
+	lsm, err := NewLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	keyCount := 5 * maxMemoryNodeCount
+	for i := 0; i < keyCount; i++ {
+		err = lsm.Set(fmt.Sprintf("key%04d", i), "value")
+		if err != nil {
+			t.Fatalf("can't set key error %v", err)
+			lsm.Close()
+			return
+		}
+	}
+
+	checkPaths := func(fast int, slow int) bool {
+		tables := lsm.Stats().Tables
+		for i, ts := range tables {
+			dir := "/slow"
+			if i >= len(tables)-fast {
+				dir = "/fast"
+			}
+			if filepath.Dir(ts.Path) != dir {
+				t.Fatalf("table %d size %d path %s expected in %s", ts.Id, ts.Size, ts.Path, dir)
+				return false
+			}
+		}
+		if len(tables) != fast+slow {
+			t.Fatalf("table count %d", len(tables))
+			return false
+		}
+		return true
+	}
+
+	err = lsm.WaitForMerges()
+	if err != nil {
+		t.Fatalf("can't wait for merges error %v", err)
+		lsm.Close()
+		return
+	}
+
+	// The two newest tables fill the fast path
+	if !checkPaths(2, 3) {
+		lsm.Close()
+		return
+	}
+	lsm.Close()
+
+	lsm, err = OpenLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	if !checkPaths(2, 3) {
+		return
+	}
+
+	for i := 0; i < keyCount; i++ {
+		value, err := lsm.Get(fmt.Sprintf("key%04d", i))
+		if err != nil || value != "value" {
+			t.Fatalf("get key %d value %s error %v", i, value, err)
+			return
+		}
+	}
+
+	err = lsm.CompactRange("", "")
+	if err != nil {
+		t.Fatalf("can't compact error %v", err)
+		return
+	}
+	if !checkPaths(0, 1) {
+		return
+	}
+
+	infos, err := opts.FS.ReadDir("/fast")
+	if err != nil || len(infos) != 0 {
+		t.Fatalf("fast path holds %d files error %v", len(infos), err)
+		return
+	}
+}
+
+func TestLsmFIFOCompaction(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	tableSize := maxMemoryNodeCount * newLsmNode("key0000", "value").diskSize()
+	opts := DefaultLsmOptions()
+	opts.FS = vfs.NewMemFS()
+	opts.CompactionPolicy = FIFOCompactionPolicy{MaxSize: 3 * tableSize}
+
+	lsm, err := NewLsmWithOptions(log, "/TestLsmFIFOCompaction", opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	keyCount := 10 * maxMemoryNodeCount
+	for i := 0; i < keyCount; i++ {
+		err = lsm.Set(fmt.Sprintf("key%04d", i), "value")
+		if err != nil {
+			t.Fatalf("can't set key error %v", err)
+			return
+		}
+	}
+
+	err = lsm.WaitForMerges()
+	if err != nil {
+		t.Fatalf("can't wait for merges error %v", err)
+		return
+	}
+
+	tables := lsm.Stats().Tables
+	if len(tables) != 3 {
+		t.Fatalf("table count %d", len(tables))
+		return
+	}
+
+	// Only the keys of the three newest tables are left
+	for i := 0; i < keyCount; i++ {
+		value, err := lsm.Get(fmt.Sprintf("key%04d", i))
+		if i < keyCount-3*maxMemoryNodeCount {
+			if err != ErrNotFound {
+				t.Fatalf("get dropped key %d value %s error %v", i, value, err)
+				return
+			}
+		} else if err != nil || value != "value" {
+			t.Fatalf("get key %d value %s error %v", i, value, err)
+			return
+		}
+	}
+}
+
+func TestLsmTimeWindowCompaction(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	window := time.Second
+	opts := DefaultLsmOptions()
+	opts.FS = vfs.NewMemFS()
+	opts.CompactionPolicy = TimeWindowCompactionPolicy{Window: window}
+
+	lsm, err := NewLsmWithOptions(log, "/TestLsmTimeWindowCompaction", opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	waitNextWindow := func() {
+		now := time.Now().UnixNano()
+		time.Sleep(time.Duration(int64(window)-now%int64(window)) + 10*time.Millisecond)
+	}
+
+	setKeys := func(from int, count int) bool {
+		for i := from; i < from+count; i++ {
+			err := lsm.Set(fmt.Sprintf("key%04d", i), "value")
+			if err != nil {
+				t.Fatalf("can't set key error %v", err)
+				return false
+			}
+		}
+		return true
+	}
+
+	// Two tables written in one window stay apart while it lasts
+	waitNextWindow()
+	if !setKeys(0, 2*maxMemoryNodeCount) {
+		return
+	}
+	err = lsm.WaitForMerges()
+	if err != nil {
+		t.Fatalf("can't wait for merges error %v", err)
+		return
+	}
+	if n := len(lsm.Stats().Tables); n != 2 {
+		t.Fatalf("table count %d", n)
+		return
+	}
+
+	// and are merged after the first flush once it is over
+	waitNextWindow()
+	if !setKeys(2*maxMemoryNodeCount, maxMemoryNodeCount) {
+		return
+	}
+	err = lsm.WaitForMerges()
+	if err != nil {
+		t.Fatalf("can't wait for merges error %v", err)
+		return
+	}
+
+	tables := lsm.Stats().Tables
+	if len(tables) != 2 || tables[0].Count != int64(2*maxMemoryNodeCount) ||
+		tables[1].Count != int64(maxMemoryNodeCount) {
+		t.Fatalf("tables %+v", tables)
+		return
+	}
+	if tables[0].MaxTimestamp/int64(window) == tables[1].MaxTimestamp/int64(window) {
+		t.Fatalf("tables of one window %+v", tables)
+		return
+	}
+
+	for i := 0; i < 3*maxMemoryNodeCount; i++ {
+		value, err := lsm.Get(fmt.Sprintf("key%04d", i))
+		if err != nil || value != "value" {
+			t.Fatalf("get key %d value %s error %v", i, value, err)
+			return
+		}
+	}
+}
+
+func TestLsmMultiGet(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	opts := DefaultLsmOptions()
+	opts.FS = vfs.NewMemFS()
+	lsm, err := NewLsmWithOptions(log, "/TestLsmMultiGet", opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	keyCount := 12*maxMemoryNodeCount + maxMemoryNodeCount/2
+	for i := 0; i < keyCount; i++ {
+		key := fmt.Sprintf("key%05d", (i*7919)%keyCount)
+		err = lsm.Set(key, "value"+strconv.Itoa(i))
+		if err == nil && i%5 == 0 {
+			err = lsm.Set(key, "new"+strconv.Itoa(i))
+		}
+		if err == nil && i%11 == 0 {
+			err = lsm.Delete(key)
+		}
+		if err != nil {
+			t.Fatalf("can't set key error %v", err)
+			return
+		}
+	}
+
+	keys := []string{"", "key99999", "a", "zzz"}
+	for i := keyCount + 10; i >= 0; i -= 3 {
+		keys = append(keys, fmt.Sprintf("key%05d", i))
+	}
+	keys = append(keys, keys[10], keys[20])
+
+	values, errs := lsm.MultiGet(keys)
+	if len(values) != len(keys) || len(errs) != len(keys) {
+		t.Fatalf("got %d values %d errors for %d keys", len(values), len(errs), len(keys))
+		return
+	}
+
+	for i, key := range keys {
+		value, err := lsm.Get(key)
+		if value != values[i] || err != errs[i] {
+			t.Fatalf("key %s multi get %s error %v, get %s error %v", key, values[i], errs[i], value, err)
+			return
+		}
+	}
+}
+
+func TestLsmIterator(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	opts := DefaultLsmOptions()
+	opts.FS = vfs.NewMemFS()
+	lsm, err := NewLsmWithOptions(log, "/TestLsmIterator", opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	// Keys spread over several tables and the memory nodes, with
+	// overwrites and deletes shadowing older tables
+	users := []string{"alice", "bob", "carol"}
+	expected := make(map[string]string)
+	for i := 0; i < 2500; i++ {
+		key := fmt.Sprintf("%s/%04d", users[i%len(users)], (i*7919)%1500)
+		value := "value" + strconv.Itoa(i)
+		if i%13 == 0 {
+			err = lsm.Delete(key)
+			delete(expected, key)
+		} else {
+			err = lsm.Set(key, value)
+			expected[key] = value
+		}
+		if err != nil {
+			t.Fatalf("can't set key error %v", err)
+			return
+		}
+	}
+
+	check := func(it *Iterator, prefix string) bool {
+		keys := make([]string, 0)
+		for key := range expected {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		i := 0
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			if i >= len(keys) || it.Key() != keys[i] || it.Value() != expected[keys[i]] {
+				t.Fatalf("forward %d key %s value %s", i, it.Key(), it.Value())
+				return false
+			}
+			i++
+		}
+		if it.Err() != nil || i != len(keys) {
+			t.Fatalf("forward got %d of %d keys error %v", i, len(keys), it.Err())
+			return false
+		}
+
+		i = len(keys) - 1
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			if i < 0 || it.Key() != keys[i] || it.Value() != expected[keys[i]] {
+				t.Fatalf("reverse %d key %s value %s", i, it.Key(), it.Value())
+				return false
+			}
+			i--
+		}
+		if it.Err() != nil || i != -1 {
+			t.Fatalf("reverse stopped at %d error %v", i, it.Err())
+			return false
+		}
+
+		// Turning around in the middle
+		it.Seek(keys[len(keys)/2])
+		it.Next()
+		it.Prev()
+		it.Prev()
+		if !it.Valid() || it.Key() != keys[len(keys)/2-1] {
+			t.Fatalf("turn around valid %v", it.Valid())
+			return false
+		}
+
+		// SeekForPrev between keys lands on the one before
+		it.SeekForPrev(keys[10] + "x")
+		if !it.Valid() || it.Key() != keys[10] {
+			t.Fatalf("seek for prev valid %v", it.Valid())
+			return false
+		}
+		return true
+	}
+
+	it, err := lsm.NewIterator("", "")
+	if err != nil {
+		t.Fatalf("can't create iterator error %v", err)
+		return
+	}
+	ok := check(it, "")
+	it.Close()
+	if !ok {
+		return
+	}
+
+	for _, user := range users {
+		it, err = lsm.NewPrefixIterator(user + "/")
+		if err != nil {
+			t.Fatalf("can't create iterator error %v", err)
+			return
+		}
+		ok = check(it, user+"/")
+		it.Close()
+		if !ok {
+			return
+		}
+	}
+
+	// Writes after the snapshot are not seen
+	it, err = lsm.NewPrefixIterator("bob/")
+	if err != nil {
+		t.Fatalf("can't create iterator error %v", err)
+		return
+	}
+	defer it.Close()
+
+	for i := 0; i < 3*maxMemoryNodeCount; i++ {
+		err = lsm.Set(fmt.Sprintf("bob/%04d", i), "new")
+		if err != nil {
+			t.Fatalf("can't set key error %v", err)
+			return
+		}
+	}
+	check(it, "bob/")
+}
+
+// pausedCompactionPolicy keeps every table until resumed, it is picked
+// from by the merge goroutine.
+type pausedCompactionPolicy struct {
+	resumed int32
+}
+
+func (p *pausedCompactionPolicy) Pick(tables []LsmTableStats) *Compaction {
+	if atomic.LoadInt32(&p.resumed) == 0 {
+		return nil
+	}
+	return SizeTieredCompactionPolicy{MaxTables: 2}.Pick(tables)
+}
+
+func TestLsmWriteStall(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	policy := &pausedCompactionPolicy{}
+	opts := DefaultLsmOptions()
+	opts.FS = vfs.NewMemFS()
+	opts.CompactionPolicy = policy
+	opts.WriteStall = WriteStallOptions{SoftTableCount: 3, HardTableCount: 5,
+		StopTimeout: 300 * time.Millisecond}
+
+	lsm, err := NewLsmWithOptions(log, "/TestLsmWriteStall", opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	i := 0
+	for ; i < 10*maxMemoryNodeCount; i++ {
+		err = lsm.Set(fmt.Sprintf("key%04d", i), "value")
+		if err != nil {
+			break
+		}
+	}
+	if err != ErrWriteStalled || i != 5*maxMemoryNodeCount {
+		t.Fatalf("write %d error %v", i, err)
+		return
+	}
+
+	stats := lsm.Stats()
+	if len(stats.Tables) != 5 || stats.Slowdowns != int64(2*maxMemoryNodeCount) || stats.Stops != 1 ||
+		stats.StallTime < 300*time.Millisecond {
+		t.Fatalf("tables %d slowdowns %d stops %d stall time %v", len(stats.Tables), stats.Slowdowns,
+			stats.Stops, stats.StallTime)
+		return
+	}
+
+	// Writes go on once merges catch up
+	atomic.StoreInt32(&policy.resumed, 1)
+	err = lsm.Set(fmt.Sprintf("key%04d", i), "value")
+	if err != nil {
+		t.Fatalf("can't set key error %v", err)
+		return
+	}
+	err = lsm.WaitForMerges()
+	if err != nil {
+		t.Fatalf("can't wait for merges error %v", err)
+		return
+	}
+	if n := len(lsm.Stats().Tables); n != 2 {
+		t.Fatalf("table count %d", n)
+		return
+	}
+
+	for j := 0; j <= i; j++ {
+		value, err := lsm.Get(fmt.Sprintf("key%04d", j))
+		if err != nil || value != "value" {
+			t.Fatalf("get key %d value %s error %v", j, value, err)
+			return
+		}
+	}
+}
+
+type flushListener struct {
+	NopEventListener
+	begins      int32
+	completions int32
+}
+
+func (l *flushListener) OnFlushBegin(info FlushInfo) {
+	atomic.AddInt32(&l.begins, 1)
+}
+
+func (l *flushListener) OnFlushCompleted(info FlushInfo) {
+	atomic.AddInt32(&l.completions, 1)
+}
+
+// balanced tells whether every flush begun was reported completed.
+func (l *flushListener) balanced() bool {
+	return atomic.LoadInt32(&l.begins) == atomic.LoadInt32(&l.completions)
+}
+
+func TestLsmOutOfSpace(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	fs := vfs.NewMemFS()
+	listener := new(flushListener)
+	opts := DefaultLsmOptions()
+	opts.FS = fs
+	opts.EventListener = listener
+
+	rootPath := "/TestLsmOutOfSpace"
+	lsm, err := NewLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	// The log fits, the table it is flushed into doesn't
+	nodeSize := newLsmNode("key0000", "value").diskSize()
+	fs.SetCapacity(int64(maxMemoryNodeCount) * nodeSize * 3 / 2)
+
+	i := 0
+	for ; i < 2*maxMemoryNodeCount; i++ {
+		err = lsm.Set(fmt.Sprintf("key%04d", i), "value")
+		if err != nil {
+			break
+		}
+	}
+	if err != ErrNoSpace || i != maxMemoryNodeCount || !lsm.Stats().OutOfSpace {
+		t.Fatalf("write %d error %v out of space %v", i, err, lsm.Stats().OutOfSpace)
+		lsm.Close()
+		return
+	}
+
+	infos, err := fs.ReadDir(rootPath)
+	if err != nil {
+		t.Fatalf("can't read dir error %v", err)
+		lsm.Close()
+		return
+	}
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".sstable") || strings.HasSuffix(info.Name(), ".tmp") {
+			t.Fatalf("left behind %s", info.Name())
+			lsm.Close()
+			return
+		}
+	}
+
+	err = lsm.Delete("key0000")
+	if err != ErrNoSpace {
+		t.Fatalf("delete error %v", err)
+		lsm.Close()
+		return
+	}
+	if !listener.balanced() {
+		t.Fatalf("flushes begun %d completed %d", atomic.LoadInt32(&listener.begins),
+			atomic.LoadInt32(&listener.completions))
+		lsm.Close()
+		return
+	}
+
+	// Reads go on meanwhile
+	value, err := lsm.Get("key0001")
+	if err != nil || value != "value" {
+		t.Fatalf("get value %s error %v", value, err)
+		lsm.Close()
+		return
+	}
+
+	// Writes resume once space is freed
+	fs.SetCapacity(0)
+	time.Sleep(spaceRetryInterval)
+	err = lsm.Set(fmt.Sprintf("key%04d", i), "value")
+	if err != nil || lsm.Stats().OutOfSpace || len(lsm.Stats().Tables) != 1 {
+		t.Fatalf("write after recovery error %v out of space %v", err, lsm.Stats().OutOfSpace)
+		lsm.Close()
+		return
+	}
+	if !listener.balanced() || atomic.LoadInt32(&listener.completions) == 0 {
+		t.Fatalf("flushes begun %d completed %d", atomic.LoadInt32(&listener.begins),
+			atomic.LoadInt32(&listener.completions))
+		lsm.Close()
+		return
+	}
+	lsm.Close()
+
+	lsm, err = OpenLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	for j := 0; j <= i; j++ {
+		value, err := lsm.Get(fmt.Sprintf("key%04d", j))
+		if err != nil || value != "value" {
+			t.Fatalf("get key %d value %s error %v", j, value, err)
+			return
+		}
+	}
+
+	// A quota stops writes but lets deletes through
+	lsm.opts.SpaceQuota = lsm.usedSpace() + nodeSize
+	err = lsm.Set("key0000", "new")
+	if err != nil {
+		t.Fatalf("can't set key error %v", err)
+		return
+	}
+	err = lsm.Set("key0001", "new")
+	if err != ErrNoSpace || lsm.Stats().OutOfSpace {
+		t.Fatalf("write over quota error %v", err)
+		return
+	}
+	err = lsm.Delete("key0001")
+	if err != nil {
+		t.Fatalf("can't delete over quota error %v", err)
+		return
+	}
+}
+
+func TestLsmTimeTravel(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	fs := vfs.NewMemFS()
+	opts := DefaultLsmOptions()
+	opts.FS = fs
+	opts.VersionRetention = time.Hour
+
+	rootPath := "/TestLsmTimeTravel"
+	lsm, err := NewLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	// Every round overwrites the keys, flushes happen halfway through
+	// rounds so versions end up both in memory and in several tables
+	keyCount := 5 * maxMemoryNodeCount / 2
+	begin := timestamp.GetTimestamp()
+	ts := make([]int64, 3)
+	for r := range ts {
+		for i := 0; i < keyCount; i++ {
+			err = lsm.Set(fmt.Sprintf("key%04d", i), fmt.Sprintf("value%d", r))
+			if err != nil {
+				t.Fatalf("can't set key error %v", err)
+				lsm.Close()
+				return
+			}
+		}
+		if r == len(ts)-1 {
+			err = lsm.Delete("key0007")
+			if err != nil {
+				t.Fatalf("can't delete key error %v", err)
+				lsm.Close()
+				return
+			}
+		}
+		ts[r] = timestamp.GetTimestamp()
+	}
+
+	check := func(stage string) bool {
+		for r := range ts {
+			value, err := lsm.GetAt("key0005", ts[r])
+			if err != nil || value != fmt.Sprintf("value%d", r) {
+				t.Fatalf("%s get at %d value %s error %v", stage, r, value, err)
+				return false
+			}
+
+			it, err := lsm.NewIteratorAt("", "", ts[r])
+			if err != nil {
+				t.Fatalf("%s can't create iterator error %v", stage, err)
+				return false
+			}
+			count := 0
+			for it.SeekToLast(); it.Valid(); it.Prev() {
+				if it.Value() != fmt.Sprintf("value%d", r) {
+					t.Fatalf("%s iterate at %d key %s value %s", stage, r, it.Key(), it.Value())
+					it.Close()
+					return false
+				}
+				count++
+			}
+			it.Close()
+			if count != keyCount && !(r == len(ts)-1 && count == keyCount-1) {
+				t.Fatalf("%s iterate at %d count %d", stage, r, count)
+				return false
+			}
+		}
+
+		_, err := lsm.GetAt("key0007", ts[len(ts)-1])
+		if err != ErrNotFound {
+			t.Fatalf("%s get deleted error %v", stage, err)
+			return false
+		}
+		_, err = lsm.GetAt("key0005", begin)
+		if err != ErrNotFound {
+			t.Fatalf("%s get before first write error %v", stage, err)
+			return false
+		}
+		value, err := lsm.Get("key0005")
+		if err != nil || value != "value2" {
+			t.Fatalf("%s get value %s error %v", stage, value, err)
+			return false
+		}
+
+		for _, st := range lsm.Stats().Tables {
+			r, err := verifyFile(fs, opts.codec(), st.Path, true)
+			if err != nil || len(r.Corrupt) != 0 {
+				t.Fatalf("%s verify %s error %v corrupt %v", stage, st.Path, err, r.Corrupt)
+				return false
+			}
+		}
+		return true
+	}
+
+	if !check("memory") {
+		lsm.Close()
+		return
+	}
+
+	err = lsm.Flush()
+	if err != nil {
+		t.Fatalf("can't flush error %v", err)
+		lsm.Close()
+		return
+	}
+	if !check("flush") {
+		lsm.Close()
+		return
+	}
+
+	err = lsm.CompactRange("", "")
+	if err != nil {
+		t.Fatalf("can't compact error %v", err)
+		lsm.Close()
+		return
+	}
+	if !check("compact") {
+		lsm.Close()
+		return
+	}
+	lsm.Close()
+
+	lsm, err = OpenLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	if !check("reopen") {
+		return
+	}
+
+	// Reads before the retention window are refused
+	lsm.opts.VersionRetention = 0
+	_, err = lsm.GetAt("key0005", ts[0])
+	if err != ErrTimestampNotRetained {
+		t.Fatalf("get out of retention error %v", err)
+		return
+	}
+
+	// Once the retention window passes a merge drops the old versions
+	lsm.opts.VersionRetention = time.Millisecond
+	time.Sleep(10 * time.Millisecond)
+	err = lsm.CompactRange("", "")
+	if err != nil {
+		t.Fatalf("can't compact error %v", err)
+		return
+	}
+	tables := lsm.Stats().Tables
+	if len(tables) != 1 || tables[0].Count != int64(keyCount-1) {
+		t.Fatalf("tables after retention %v", tables)
+		return
+	}
+}
+
+func TestLsmRetainedDuplicates(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	fs := vfs.NewMemFS()
+	opts := DefaultLsmOptions()
+	opts.FS = fs
+	opts.VersionRetention = time.Hour
+
+	rootPath := "/TestLsmRetainedDuplicates"
+	lsm, err := NewLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	keyCount := maxMemoryNodeCount / 4
+	for r := 0; r < 2; r++ {
+		for i := 0; i < keyCount; i++ {
+			err = lsm.Set(fmt.Sprintf("key%04d", i), fmt.Sprintf("value%d", r))
+			if err != nil {
+				t.Fatalf("can't set key error %v", err)
+				lsm.Close()
+				return
+			}
+		}
+	}
+	err = lsm.Flush()
+	if err != nil {
+		t.Fatalf("can't flush error %v", err)
+		lsm.Close()
+		return
+	}
+	tables := lsm.Stats().Tables
+	lsm.Close()
+	if len(tables) != 1 {
+		t.Fatalf("tables %d", len(tables))
+		return
+	}
+
+	// A second table holding the same records, as a log replayed over
+	// its own flush left
+	err = copyFile(fs, tables[0].Path, getSsTablePathIn(rootPath, tables[0].Id+1))
+	if err != nil {
+		t.Fatalf("can't copy table error %v", err)
+		return
+	}
+
+	lsm, err = OpenLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	err = lsm.CompactRange("", "")
+	if err != nil {
+		t.Fatalf("can't compact error %v", err)
+		return
+	}
+
+	tables = lsm.Stats().Tables
+	if len(tables) != 1 {
+		t.Fatalf("compacted tables %d", len(tables))
+		return
+	}
+	r, err := VerifyFile(tables[0].Path, true, opts)
+	if err != nil || !r.Ok() || r.Records != int64(2*keyCount) {
+		t.Fatalf("verify %s error %v records %d corrupt %v", tables[0].Path, err, r.Records, r.Corrupt)
+		return
+	}
+
+	value, err := lsm.Get("key0005")
+	if err != nil || value != "value1" {
+		t.Fatalf("get value %s error %v", value, err)
+		return
+	}
+}
+
+func TestLsmSubcompaction(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	opts := DefaultLsmOptions()
+	opts.FS = vfs.NewMemFS()
+	opts.MaxSubcompactions = 4
+	opts.SubcompactionMinSize = 1
+
+	rootPath := "/TestLsmSubcompaction"
+	lsm, err := NewLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	keyCount := 5 * keysPerIndex
+	for i := 0; i < keyCount; i++ {
+		err = lsm.Set(fmt.Sprintf("key%05d", i), fmt.Sprintf("value%d", i))
+		if err != nil {
+			t.Fatalf("can't set key error %v", err)
+			lsm.Close()
+			return
+		}
+	}
+	for i := 0; i < keyCount; i += 3 {
+		err = lsm.Delete(fmt.Sprintf("key%05d", i))
+		if err != nil {
+			t.Fatalf("can't delete key error %v", err)
+			lsm.Close()
+			return
+		}
+	}
+
+	err = lsm.CompactRange("", "")
+	if err != nil {
+		t.Fatalf("can't compact error %v", err)
+		lsm.Close()
+		return
+	}
+
+	check := func(stage string) bool {
+		tables := lsm.Stats().Tables
+		if len(tables) < 2 || len(tables) > opts.MaxSubcompactions {
+			t.Fatalf("%s tables %d", stage, len(tables))
+			return false
+		}
+
+		// The shards don't overlap and hold no tombstones
+		count := int64(0)
+		for i, ts := range tables {
+			if i > 0 && ts.MinKey <= tables[i-1].MaxKey && ts.MaxKey >= tables[i-1].MinKey {
+				t.Fatalf("%s tables %v and %v overlap", stage, ts, tables[i-1])
+				return false
+			}
+			if ts.TombstoneRatio != 0 {
+				t.Fatalf("%s table %v has tombstones", stage, ts)
+				return false
+			}
+			count += ts.Count
+		}
+		if count != int64(keyCount-(keyCount+2)/3) {
+			t.Fatalf("%s count %d", stage, count)
+			return false
+		}
+
+		for i := 0; i < keyCount; i++ {
+			value, err := lsm.Get(fmt.Sprintf("key%05d", i))
+			if i%3 == 0 {
+				if err != ErrNotFound {
+					t.Fatalf("%s get deleted key %d error %v", stage, i, err)
+					return false
+				}
+				continue
+			}
+			if err != nil || value != fmt.Sprintf("value%d", i) {
+				t.Fatalf("%s get key %d value %s error %v", stage, i, value, err)
+				return false
+			}
+		}
+		return true
+	}
+
+	if !check("compact") {
+		lsm.Close()
+		return
+	}
+	lsm.Close()
+
+	lsm, err = OpenLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	check("reopen")
+}
+
+func TestLsmBatchOutOfSpace(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	opts := DefaultLsmOptions()
+	opts.FS = fs
+
+	rootPath := "/TestLsmBatchOutOfSpace"
+	lsm, err := NewLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	err = lsm.Set("key0", "value0")
+	if err != nil {
+		t.Fatalf("can't set key error %v", err)
+		lsm.Close()
+		return
+	}
+
+	// A plain text record takes three writes, the batch fails in the
+	// middle of its second record
+	b := NewWriteBatch()
+	b.Set("key1", "value1")
+	b.Set("key2", "value2")
+	fs.FailWrites(4, syscall.ENOSPC)
+	err = lsm.Write(b)
+	if err != ErrNoSpace {
+		t.Fatalf("batch error %v", err)
+		lsm.Close()
+		return
+	}
+
+	// So does the following record after the first of its writes
+	time.Sleep(spaceRetryInterval)
+	fs.FailWrites(1, syscall.ENOSPC)
+	err = lsm.Set("key3", "value3")
+	if err != ErrNoSpace {
+		t.Fatalf("set error %v", err)
+		lsm.Close()
+		return
+	}
+
+	fs.FailWrites(0, nil)
+	time.Sleep(spaceRetryInterval)
+	err = lsm.Set("key4", "value4")
+	if err != nil {
+		t.Fatalf("can't set key after space is back error %v", err)
+		lsm.Close()
+		return
+	}
+	lsm.Close()
+
+	lsm, err = OpenLsmWithOptions(log, rootPath, opts)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	for _, key := range []string{"key0", "key4"} {
+		_, err = lsm.Get(key)
+		if err != nil {
+			t.Fatalf("get %s error %v", key, err)
+			return
+		}
+	}
+	for _, key := range []string{"key1", "key2", "key3"} {
+		_, err = lsm.Get(key)
+		if err != ErrNotFound {
+			t.Fatalf("get failed %s error %v", key, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package lsm
+
+import (
+	"io"
+	"sort"
+	"sync/atomic"
+)
+
+// multiGet calls found with the node of every key of the sorted keys held by
+// the table. The keys are looked up in one pass over the file, the reader
+// only moves to the index block of a key if that block starts past the
+// current node.
+func (st *SsTable) multiGet(keys []string, found func(node *LsmNode)) error {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	if st.minKey == nil {
+		return nil
+	}
+
+	if st.file == nil {
+		return ErrTableClosed
+	}
+
+	var nr *nodeReader
+	var node *LsmNode
+	for _, key := range keys {
+		if key < *st.minKey {
+			continue
+		}
+		if key > *st.maxKey {
+			break
+		}
+
+		offset := st.dataOffset
+		if len(st.keys) > 0 {
+			keyIndex := sort.SearchStrings(st.keys, key)
+			if keyIndex > 0 {
+				keyIndex--
+			}
+			offset = st.keyToOffset[st.keys[keyIndex]]
+		}
+
+		if nr == nil || (node.key < key && offset > nr.offset) {
+			nr = st.newNodeReader(io.NewSectionReader(st.file, offset, st.size-offset), offset)
+			node = nil
+		}
+
+		for node == nil || node.key < key {
+			next, err := nr.next()
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			node = next
+		}
+
+		if node.key == key {
+			found(node)
+		}
+	}
+	return nil
+}
+
+// MultiGet looks up keys in one go and returns the value and the error of
+// each in the order of keys. The locks are taken once and every table is
+// read in a single pass over the sorted keys it may hold.
+func (lsm *Lsm) MultiGet(keys []string) ([]string, []error) {
+	values := make([]string, len(keys))
+	errs := make([]error, len(keys))
+
+	atomic.AddInt64(&lsm.counters.gets, int64(len(keys)))
+
+	lsm.nodeMapLock.RLock()
+	defer lsm.nodeMapLock.RUnlock()
+
+	// Positions of every key still to find, duplicates share the lookup
+	pending := make(map[string][]int)
+	for i, key := range keys {
+		if key == "" {
+			errs[i] = ErrEmptyKey
+			continue
+		}
+
+		node, ok := lsm.nodeMap[key]
+		if ok {
+			atomic.AddInt64(&lsm.counters.memoryHits, 1)
+			if node.deleted {
+				errs[i] = ErrNotFound
+			} else {
+				values[i] = node.value
+			}
+			continue
+		}
+		pending[key] = append(pending[key], i)
+	}
+
+	if len(pending) == 0 {
+		return values, errs
+	}
+
+	sorted := make([]string, 0, len(pending))
+	for key := range pending {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	resolve := func(key string, value string, err error) {
+		for _, i := range pending[key] {
+			values[i] = value
+			errs[i] = err
+		}
+		delete(pending, key)
+	}
+
+	lsm.ssTableMapLock.RLock()
+	defer lsm.ssTableMapLock.RUnlock()
+
+	ids := make([]int64, 0, len(lsm.ssTableMap))
+	for id := range lsm.ssTableMap {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+
+	for _, id := range ids {
+		if len(sorted) == 0 {
+			break
+		}
+
+		atomic.AddInt64(&lsm.counters.tableProbes, 1)
+		err := lsm.ssTableMap[id].multiGet(sorted, func(node *LsmNode) {
+			if node.deleted {
+				resolve(node.key, "", ErrNotFound)
+			} else {
+				resolve(node.key, node.value, nil)
+			}
+		})
+		if err != nil {
+			for _, key := range sorted {
+				if _, ok := pending[key]; ok {
+					resolve(key, "", err)
+				}
+			}
+			return values, errs
+		}
+
+		left := sorted[:0]
+		for _, key := range sorted {
+			if _, ok := pending[key]; ok {
+				left = append(left, key)
+			}
+		}
+		sorted = left
+	}
+
+	for _, key := range sorted {
+		resolve(key, "", ErrNotFound)
+	}
+	return values, errs
+}
+
+func (cf *ColumnFamily) MultiGet(keys []string) ([]string, []error) {
+	if cf.dropped() {
+		errs := make([]error, len(keys))
+		for i := range errs {
+			errs[i] = ErrColumnFamilyNotFound
+		}
+		return make([]string, len(keys)), errs
+	}
+	return cf.lsm.MultiGet(keys)
+}
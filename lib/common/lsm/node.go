@@ -14,17 +14,108 @@ import (
 var (
 	ErrLsmNodeBadMagic    = fmt.Errorf("Lsm node bad magic")
 	ErrLsmNodeBadCheckSum = fmt.Errorf("Lsm node bad checksum")
+	ErrLsmNodeTooLarge    = fmt.Errorf("Lsm node key or value too large")
+	ErrKeyTooLarge        = fmt.Errorf("Key too large")
+	ErrValueTooLarge      = fmt.Errorf("Value too large")
 )
 
 const (
-	LsmNodeMagic = uint32(0x4CBDABDA)
-	IoBlockSize  = 512
+	LsmNodeMagic        = uint32(0x4CBDABDA)
+	IoBlockSize         = 512
+	DefaultMaxKeySize   = 64 * 1024
+	DefaultMaxValueSize = 64 * 1024 * 1024
+)
+
+const (
+	lsmNodeFlagDeleted = uint32(1 << 0)
+	lsmNodeFlagStamped = uint32(1 << 1)
+	// lsmNodeFlagFamily marks a log record of a column family other than
+	// the default one
+	lsmNodeFlagFamily = uint32(1 << 2)
+	// lsmNodeFlagBatch marks a log record which is followed by batchLeft
+	// more records of the same write batch
+	lsmNodeFlagBatch  = uint32(1 << 3)
+	lsmNodeHeaderSize = 16 + 8 + 16 + 8
 )
 
 type LsmNode struct {
-	key     string
-	value   string
-	deleted bool
+	key       string
+	value     string
+	deleted   bool
+	seq       uint64
+	timestamp int64
+	family    uint32
+	batchLeft uint32
+	// older is the version this one replaced in memory, kept for reads
+	// within VersionRetention
+	older *LsmNode
+	// checksum is the one stored with a node read from a file
+	checksum uint64
+}
+
+// sizeLimits bound keys and values. Larger ones are refused on write and
+// taken for corruption on read, so a bad header can't make a reader
+// allocate gigabytes.
+type sizeLimits struct {
+	maxKeySize   int
+	maxValueSize int
+}
+
+var defaultSizeLimits = sizeLimits{maxKeySize: DefaultMaxKeySize, maxValueSize: DefaultMaxValueSize}
+
+func newSizeLimits(maxKeySize int, maxValueSize int) sizeLimits {
+	l := defaultSizeLimits
+	if maxKeySize > 0 {
+		l.maxKeySize = maxKeySize
+	}
+	if maxValueSize > 0 {
+		l.maxValueSize = maxValueSize
+	}
+	return l
+}
+
+func (l sizeLimits) check(key string, value string) error {
+	if len(key) > l.maxKeySize {
+		return ErrKeyTooLarge
+	}
+	if len(value) > l.maxValueSize {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// nodeCodec is how the nodes of a file are encoded, keys is nil for plain
+// text files.
+type nodeCodec struct {
+	keys   KeyProvider
+	limits sizeLimits
+}
+
+var defaultNodeCodec = nodeCodec{limits: defaultSizeLimits}
+
+// CorruptionError reports a record of FilePath at Offset which can't be
+// decoded, Err is the reason.
+type CorruptionError struct {
+	FilePath string
+	Offset   int64
+	Err      error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%s is corrupt at offset %d: %v", e.FilePath, e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+func isCorruption(err error) bool {
+	switch err {
+	case ErrLsmNodeBadMagic, ErrLsmNodeBadCheckSum, ErrLsmNodeTooLarge, ErrLsmNodeBadSeal,
+		ErrLsmNodeNotSealed, io.ErrUnexpectedEOF:
+		return true
+	}
+	return false
 }
 
 func newLsmNode(key string, value string) *LsmNode {
@@ -80,80 +171,212 @@ func getAlignedBlockByLen(srcLen int, alignSize int) []byte {
 	return getAlignedBlock(blockSize, alignSize)
 }
 
-func (node *LsmNode) WriteTo(f io.Writer) error {
-	key := []byte(node.key)
-	value := []byte(node.value)
-	deleted := uint32(0)
+func getAlignedLen(srcLen int, alignSize int) int {
+	return ((srcLen + alignSize - 1) / alignSize) * alignSize
+}
+
+// diskSize is the number of bytes WriteTo writes
+func (node *LsmNode) diskSize() int64 {
+	return int64(getAlignedLen(lsmNodeHeaderSize, IoBlockSize) +
+		getAlignedLen(len(node.key), IoBlockSize) +
+		getAlignedLen(len(node.value), IoBlockSize))
+}
+
+// header returns the node header with the checksum of header, key and value
+func (node *LsmNode) header() []byte {
+	flags := uint32(0)
 	if node.deleted {
-		deleted = 1
+		flags |= lsmNodeFlagDeleted
+	}
+	if node.seq != 0 {
+		flags |= lsmNodeFlagStamped
+	}
+	if node.family != 0 {
+		flags |= lsmNodeFlagFamily
+	}
+	if node.batchLeft != 0 {
+		flags |= lsmNodeFlagBatch
 	}
 
-	header := make([]byte, 16+8)
+	header := make([]byte, lsmNodeHeaderSize)
 	binary.LittleEndian.PutUint32(header[0:], LsmNodeMagic)
-	binary.LittleEndian.PutUint32(header[4:], deleted)
-	binary.LittleEndian.PutUint32(header[8:], uint32(len(key)))
-	binary.LittleEndian.PutUint32(header[12:], uint32(len(value)))
+	binary.LittleEndian.PutUint32(header[4:], flags)
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(node.key)))
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(node.value)))
+	binary.LittleEndian.PutUint64(header[24:], node.seq)
+	binary.LittleEndian.PutUint64(header[32:], uint64(node.timestamp))
+	binary.LittleEndian.PutUint32(header[40:], node.family)
+	binary.LittleEndian.PutUint32(header[44:], node.batchLeft)
+	copy(header[16:16+8], checksum(header, []byte(node.key), []byte(node.value)))
+	return header
+}
+
+func checksum(header []byte, key []byte, value []byte) []byte {
+	flags := binary.LittleEndian.Uint32(header[4:])
 
 	h := xxhash.New64()
 	h.Write(header[0:16])
+	if flags&lsmNodeFlagStamped != 0 {
+		h.Write(header[24:40])
+	}
+	if flags&(lsmNodeFlagFamily|lsmNodeFlagBatch) != 0 {
+		h.Write(header[40:48])
+	}
 	h.Write(key)
 	h.Write(value)
-	copy(header[16:16+8], h.Sum(nil))
+	return h.Sum(nil)
+}
 
-	_, err := f.Write(getCopiedAlignedBlock(header, IoBlockSize))
+func (node *LsmNode) WriteTo(f io.Writer) error {
+	_, err := f.Write(getCopiedAlignedBlock(node.header(), IoBlockSize))
 	if err != nil {
 		return err
 	}
 
-	_, err = f.Write(getCopiedAlignedBlock(key, IoBlockSize))
+	_, err = f.Write(getCopiedAlignedBlock([]byte(node.key), IoBlockSize))
 	if err != nil {
 		return err
 	}
 
-	_, err = f.Write(getCopiedAlignedBlock(value, IoBlockSize))
+	_, err = f.Write(getCopiedAlignedBlock([]byte(node.value), IoBlockSize))
 	return err
 }
 
-func (node *LsmNode) ReadFrom(f io.Reader) error {
-	header := getAlignedBlockByLen(16+8, IoBlockSize)
-	_, err := f.Read(header)
+// writeTo writes the node sealed by c for the file offset it goes to, or in
+// plain text if c is nil.
+func (node *LsmNode) writeTo(f io.Writer, c *fileCipher, offset int64) error {
+	if c == nil {
+		return node.WriteTo(f)
+	}
+
+	frame, err := c.seal(node, offset)
 	if err != nil {
 		return err
 	}
+	_, err = f.Write(frame)
+	return err
+}
 
-	if binary.LittleEndian.Uint32(header[0:]) != LsmNodeMagic {
-		return ErrLsmNodeBadMagic
-	}
+func (node *LsmNode) ReadFrom(f io.Reader) error {
+	_, err := node.readFrom(f, nil, 0, defaultSizeLimits)
+	return err
+}
 
-	keyLength := int(binary.LittleEndian.Uint32(header[8:]))
-	valueLength := int(binary.LittleEndian.Uint32(header[12:]))
+// readFull fills block, running out of data in the middle of a node is
+// io.ErrUnexpectedEOF.
+func readFull(f io.Reader, block []byte) error {
+	_, err := io.ReadFull(f, block)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
 
-	key := getAlignedBlockByLen(keyLength, IoBlockSize)
-	value := getAlignedBlockByLen(valueLength, IoBlockSize)
-	_, err = f.Read(key)
+// readFrom reads a plain text node or one sealed by c at the file offset and
+// returns the number of bytes it took. A file with a cipher holds sealed
+// nodes only. io.EOF is returned only if the file ends before the node.
+func (node *LsmNode) readFrom(f io.Reader, c *fileCipher, offset int64, limits sizeLimits) (int64, error) {
+	header := getAlignedBlockByLen(lsmNodeHeaderSize, IoBlockSize)
+	_, err := io.ReadFull(f, header)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	switch binary.LittleEndian.Uint32(header[0:]) {
+	case LsmNodeMagic:
+		if c != nil {
+			return 0, ErrLsmNodeNotSealed
+		}
+	case sealedNodeMagic:
+		if c == nil {
+			return 0, ErrNoKeyProvider
+		}
+		return node.readSealed(f, header, c, offset, limits)
+	default:
+		return 0, ErrLsmNodeBadMagic
+	}
+
+	keyLength := int64(binary.LittleEndian.Uint32(header[8:]))
+	valueLength := int64(binary.LittleEndian.Uint32(header[12:]))
+	if keyLength > int64(limits.maxKeySize) || valueLength > int64(limits.maxValueSize) {
+		return 0, ErrLsmNodeTooLarge
 	}
-	_, err = f.Read(value)
+
+	key := getAlignedBlockByLen(int(keyLength), IoBlockSize)
+	value := getAlignedBlockByLen(int(valueLength), IoBlockSize)
+	if len(key) != 0 {
+		err = readFull(f, key)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(value) != 0 {
+		err = readFull(f, value)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = node.decode(header[0:lsmNodeHeaderSize], key[0:keyLength], value[0:valueLength])
 	if err != nil {
-		return err
+		return 0, err
 	}
+	return int64(len(header) + len(key) + len(value)), nil
+}
 
-	h := xxhash.New64()
-	h.Write(header[0:16])
-	h.Write(key[0:keyLength])
-	h.Write(value[0:valueLength])
+// nodeReader reads consecutive nodes of one file starting at offset.
+type nodeReader struct {
+	r        io.Reader
+	filePath string
+	offset   int64
+	cipher   *fileCipher
+	limits   sizeLimits
+}
+
+// next returns io.EOF at the end of the file and a *CorruptionError for a
+// node which can't be decoded.
+func (nr *nodeReader) next() (*LsmNode, error) {
+	node := new(LsmNode)
+	size, err := node.readFrom(nr.r, nr.cipher, nr.offset, nr.limits)
+	if err != nil {
+		if isCorruption(err) {
+			return nil, &CorruptionError{FilePath: nr.filePath, Offset: nr.offset, Err: err}
+		}
+		return nil, err
+	}
+	nr.offset += size
+	return node, nil
+}
 
-	if !bytes.Equal(header[16:16+8], h.Sum(nil)) {
+// decode fills the node from its header, key and value after checking the
+// checksum.
+func (node *LsmNode) decode(header []byte, key []byte, value []byte) error {
+	if !bytes.Equal(header[16:16+8], checksum(header, key, value)) {
 		return ErrLsmNodeBadCheckSum
 	}
+	node.checksum = binary.LittleEndian.Uint64(header[16:])
 
-	node.key = string(key[0:keyLength])
-	node.value = string(value[0:valueLength])
+	flags := binary.LittleEndian.Uint32(header[4:])
+	node.key = string(key)
+	node.value = string(value)
 	node.deleted = false
-	if binary.LittleEndian.Uint32(header[4:]) != 0 {
+	if flags&lsmNodeFlagDeleted != 0 {
 		node.deleted = true
 	}
+	node.seq = 0
+	node.timestamp = 0
+	if flags&lsmNodeFlagStamped != 0 {
+		node.seq = binary.LittleEndian.Uint64(header[24:])
+		node.timestamp = int64(binary.LittleEndian.Uint64(header[32:]))
+	}
+	node.family = 0
+	if flags&lsmNodeFlagFamily != 0 {
+		node.family = binary.LittleEndian.Uint32(header[40:])
+	}
+	node.batchLeft = 0
+	if flags&lsmNodeFlagBatch != 0 {
+		node.batchLeft = binary.LittleEndian.Uint32(header[44:])
+	}
 
 	return nil
 }
@@ -0,0 +1,443 @@
+package lsm
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrBadCompaction = fmt.Errorf("Compaction policy picked bad tables")
+)
+
+// Compaction is one step picked by a CompactionPolicy.
+type Compaction struct {
+	// Merge lists neighbouring tables merged into one, which keeps the id of
+	// the newest of them so shadowing between tables is preserved
+	Merge []int64
+	// Drop lists tables deleted with all their data
+	Drop []int64
+}
+
+// CompactionPolicy decides which tables are merged or dropped after every
+// flush. Pick gets the tables oldest first and is called again after each
+// step until it returns nil.
+type CompactionPolicy interface {
+	Pick(tables []LsmTableStats) *Compaction
+}
+
+// SizeTieredCompactionPolicy merges the pair of neighbouring tables with the
+// smallest total size while there are more than MaxTables, zero means 8.
+// It is the default policy.
+type SizeTieredCompactionPolicy struct {
+	MaxTables int
+}
+
+func (p SizeTieredCompactionPolicy) Pick(tables []LsmTableStats) *Compaction {
+	maxTables := p.MaxTables
+	if maxTables <= 0 {
+		maxTables = maxSsTableCount
+	}
+	if len(tables) <= maxTables || len(tables) < 2 {
+		return nil
+	}
+
+	best := 0
+	for i := 1; i+1 < len(tables); i++ {
+		if tables[i].Size+tables[i+1].Size < tables[best].Size+tables[best+1].Size {
+			best = i
+		}
+	}
+	return &Compaction{Merge: []int64{tables[best].Id, tables[best+1].Id}}
+}
+
+// FIFOCompactionPolicy never merges. Once the tables take more than MaxSize
+// bytes the oldest ones are dropped with their data, the newest table is
+// always kept.
+type FIFOCompactionPolicy struct {
+	MaxSize int64
+}
+
+func (p FIFOCompactionPolicy) Pick(tables []LsmTableStats) *Compaction {
+	total := int64(0)
+	for _, t := range tables {
+		total += t.Size
+	}
+
+	drop := make([]int64, 0)
+	for i := 0; i+1 < len(tables) && total > p.MaxSize; i++ {
+		drop = append(drop, tables[i].Id)
+		total -= tables[i].Size
+	}
+	if len(drop) == 0 {
+		return nil
+	}
+	return &Compaction{Drop: drop}
+}
+
+// TimeWindowCompactionPolicy merges neighbouring tables whose newest record
+// was written in the same Window once that window is over. Tables of the
+// current window and tables without write times are left alone.
+type TimeWindowCompactionPolicy struct {
+	Window time.Duration
+}
+
+func (p TimeWindowCompactionPolicy) window(t LsmTableStats) int64 {
+	if t.MaxTimestamp <= 0 {
+		return -1
+	}
+	return t.MaxTimestamp / int64(p.Window)
+}
+
+func (p TimeWindowCompactionPolicy) Pick(tables []LsmTableStats) *Compaction {
+	if p.Window <= 0 {
+		return nil
+	}
+
+	current := time.Now().UnixNano() / int64(p.Window)
+	for i := 0; i < len(tables); {
+		w := p.window(tables[i])
+		j := i + 1
+		for j < len(tables) && p.window(tables[j]) == w {
+			j++
+		}
+		if w >= 0 && w < current && j-i >= 2 {
+			merge := make([]int64, 0, j-i)
+			for _, t := range tables[i:j] {
+				merge = append(merge, t.Id)
+			}
+			return &Compaction{Merge: merge}
+		}
+		i = j
+	}
+	return nil
+}
+
+func (lsm *Lsm) compactionPolicy() CompactionPolicy {
+	if lsm.opts.CompactionPolicy == nil {
+		return SizeTieredCompactionPolicy{}
+	}
+	return lsm.opts.CompactionPolicy
+}
+
+// sortedSsTableIds returns the ids of the tables oldest first. Must be
+// called with ssTableMapLock held.
+func (lsm *Lsm) sortedSsTableIds() []int64 {
+	ids := make([]int64, 0, len(lsm.ssTableMap))
+	for id := range lsm.ssTableMap {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// checkCompaction makes sure c refers to existing tables only and that the
+// tables to merge are neighbours once the dropped ones are gone.
+func (lsm *Lsm) checkCompaction(c *Compaction) error {
+	if len(c.Merge) == 0 && len(c.Drop) == 0 {
+		return ErrBadCompaction
+	}
+
+	dropped := make(map[int64]bool)
+	for _, id := range c.Drop {
+		if _, ok := lsm.ssTableMap[id]; !ok || dropped[id] {
+			return ErrBadCompaction
+		}
+		dropped[id] = true
+	}
+
+	if len(c.Merge) == 0 {
+		return nil
+	}
+	if len(c.Merge) < 2 {
+		return ErrBadCompaction
+	}
+
+	merge := append([]int64{}, c.Merge...)
+	sort.Slice(merge, func(i, j int) bool { return merge[i] < merge[j] })
+	ids := make([]int64, 0)
+	for _, id := range lsm.sortedSsTableIds() {
+		if !dropped[id] {
+			ids = append(ids, id)
+		}
+	}
+
+	start := sort.Search(len(ids), func(i int) bool { return ids[i] >= merge[0] })
+	if start+len(merge) > len(ids) {
+		return ErrBadCompaction
+	}
+	for i, id := range merge {
+		if ids[start+i] != id {
+			return ErrBadCompaction
+		}
+	}
+	return nil
+}
+
+// compactSsTables runs the steps picked by the compaction policy. Must be
+// called with mergeLock held, ssTableMapLock is taken only to pick a step
+// and to swap tables.
+func (lsm *Lsm) compactSsTables() error {
+	policy := lsm.compactionPolicy()
+	for {
+		c, err := lsm.nextCompaction(policy)
+		if err != nil || c == nil {
+			return err
+		}
+
+		if len(c.Merge) != 0 {
+			merge := append([]int64{}, c.Merge...)
+			sort.Slice(merge, func(i, j int) bool { return merge[i] < merge[j] })
+			err = lsm.mergeSsTableRun(merge)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// nextCompaction picks the next step of policy and drops the tables it
+// names, the merge is left to the caller.
+func (lsm *Lsm) nextCompaction(policy CompactionPolicy) (*Compaction, error) {
+	lsm.ssTableMapLock.Lock()
+	defer lsm.ssTableMapLock.Unlock()
+
+	c := policy.Pick(lsm.tableStats())
+	if c == nil {
+		return nil, nil
+	}
+
+	err := lsm.checkCompaction(c)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range c.Drop {
+		lsm.dropSsTable(id)
+	}
+	return c, nil
+}
+
+// runMerges runs the merges and table moves asked for by the compaction
+// policy and the data paths on the root and every column family. Writes and
+// reads go on meanwhile.
+func (lsm *Lsm) runMerges() error {
+	lsm.nodeMapLock.RLock()
+	all := []*Lsm{lsm}
+	for _, family := range lsm.families {
+		all = append(all, family)
+	}
+	lsm.nodeMapLock.RUnlock()
+
+	var firstErr error
+	for _, l := range all {
+		err := l.runFamilyMerges()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (lsm *Lsm) runFamilyMerges() error {
+	lsm.mergeLock.Lock()
+	defer lsm.mergeLock.Unlock()
+
+	err := lsm.compactSsTables()
+	if err != nil {
+		return err
+	}
+
+	lsm.ssTableMapLock.Lock()
+	defer lsm.ssTableMapLock.Unlock()
+	return lsm.placeSsTables()
+}
+
+// scheduleMerge wakes the background goroutine of the root to run the
+// merges, a wakeup still pending covers this one too.
+func (lsm *Lsm) scheduleMerge() {
+	select {
+	case lsm.compactChan <- true:
+	default:
+	}
+}
+
+// WaitForMerges runs the merges the compaction policy still asks for and
+// returns once there are none left. Flushes leave merges to the
+// background, so a table count right after a write may be over the policy.
+func (lsm *Lsm) WaitForMerges() error {
+	if lsm.readOnly {
+		return ErrReadOnly
+	}
+	return lsm.root.runMerges()
+}
+
+func (lsm *Lsm) dropSsTable(id int64) error {
+	st := lsm.ssTableMap[id]
+	lsm.log.Pf(0, "drop table %d size %d", id, st.size)
+	delete(lsm.ssTableMap, id)
+	return st.Erase()
+}
+
+// dropTombstones rewrites table id without tombstones once no older table
+// is left whose data they could hide. Must be called with mergeLock held.
+func (lsm *Lsm) dropTombstones(id int64) error {
+	lsm.ssTableMapLock.RLock()
+	st := lsm.ssTableMap[id]
+	filePath := st.filePath
+	lsm.ssTableMapLock.RUnlock()
+
+	tmpFilePath := filePath + ".tmp"
+	lsm.log.Pf(0, "drop tombstones of %d", id)
+
+	newSt, err := lsm.mergeTables([]*SsTable{st}, tmpFilePath, true, "", "")
+	if err != nil {
+		return lsm.spaceError(err)
+	}
+	if newSt == nil {
+		lsm.ssTableMapLock.Lock()
+		defer lsm.ssTableMapLock.Unlock()
+		return lsm.dropSsTable(id)
+	}
+
+	// Reads keep the open file of st until it is swapped
+	err = lsm.fs.Rename(tmpFilePath, filePath)
+	if err == nil {
+		err = lsm.fs.SyncDir(filepath.Dir(filePath))
+	}
+	if err == nil {
+		err = newSt.reopen(filePath)
+	}
+	if err != nil {
+		newSt.Close()
+		lsm.fs.Remove(tmpFilePath)
+		return err
+	}
+
+	lsm.ssTableMapLock.Lock()
+	defer lsm.ssTableMapLock.Unlock()
+	st.Close()
+	atomic.AddInt64(&lsm.counters.tableBytes, newSt.size)
+	lsm.addSsTable(id, newSt)
+	return nil
+}
+
+// mergeSsTableRun merges neighbouring tables, ids oldest first, into one
+// which takes the id of the newest. Must be called with mergeLock held, it
+// keeps the inputs in place while the output is written without
+// ssTableMapLock.
+func (lsm *Lsm) mergeSsTableRun(ids []int64) error {
+	lsm.ssTableMapLock.RLock()
+	tables := make([]*SsTable, len(ids))
+	size := int64(0)
+	for i, id := range ids {
+		tables[len(ids)-1-i] = lsm.ssTableMap[id]
+		size += lsm.ssTableMap[id].size
+	}
+	currStId := ids[len(ids)-1]
+	currSt := tables[0]
+
+	// Tombstones only hide data in older tables, there are no snapshots
+	// which could still need the versions they shadow
+	dropDeleted := !lsm.olderTablesOverlap(ids[0], tables...)
+
+	// The output is written straight into the path it belongs on
+	currFilePath := currSt.filePath
+	dstFilePath := getSsTablePathIn(lsm.dataPathFor(currStId, size), currStId)
+	tmpFilePath := dstFilePath + ".tmp"
+	lsm.ssTableMapLock.RUnlock()
+
+	lsm.log.Pf(0, "merge %v -> %d drop deleted %v", ids, currStId, dropDeleted)
+	begin := time.Now()
+	info := CompactionInfo{Inputs: append([]int64{}, ids...), Outputs: []int64{}, DropDeleted: dropDeleted}
+	lsm.opts.EventListener.OnCompactionBegin(info)
+	defer func() {
+		atomic.AddInt64(&lsm.counters.merges, 1)
+		lsm.counters.mergeDuration.Append(sinceUs(begin))
+		info.Duration = sinceDuration(begin)
+		lsm.opts.EventListener.OnCompactionCompleted(info)
+	}()
+
+	// Merges wait for space without stopping writes, flushes don't need
+	// as much
+	err := lsm.checkFreeSpace(size)
+	if err != nil {
+		return err
+	}
+	// Tombstones are kept until the older inputs are gone, the output
+	// replaces the newest input first and they hide what the others hold
+	// should a crash come in between
+	newSt, err := lsm.mergeTables(tables, tmpFilePath, false, "", "")
+	if err != nil {
+		return lsm.spaceError(err)
+	}
+
+	if newSt == nil {
+		lsm.ssTableMapLock.Lock()
+		for _, id := range ids {
+			lsm.dropSsTable(id)
+		}
+		lsm.ssTableMapLock.Unlock()
+		lsm.log.Pf(0, "merge %v -> nothing left", ids)
+		return nil
+	}
+
+	err = lsm.fs.Rename(tmpFilePath, dstFilePath)
+	if err == nil {
+		err = lsm.fs.SyncDir(filepath.Dir(dstFilePath))
+	}
+	if err == nil {
+		err = newSt.reopen(dstFilePath)
+	}
+	if err != nil {
+		newSt.Close()
+		lsm.fs.Remove(tmpFilePath)
+		return err
+	}
+
+	lsm.ssTableMapLock.Lock()
+	currSt.Close()
+
+	// Until the old file is gone both are found on open, either one
+	// together with the older inputs holds the same data as the output
+	// still has the tombstones
+	if dstFilePath != currFilePath {
+		removeErr := lsm.fs.Remove(currFilePath)
+		if removeErr != nil {
+			lsm.log.Pf(0, "remove %s error %v", currFilePath, removeErr)
+		}
+	}
+
+	atomic.AddInt64(&lsm.counters.tableBytes, newSt.size)
+	lsm.addSsTable(currStId, newSt)
+	info.Outputs = append(info.Outputs, currStId)
+
+	// Oldest first, a tombstone is always newer than what it hides
+	dirs := make(map[string]bool)
+	for _, id := range ids[:len(ids)-1] {
+		dirs[filepath.Dir(lsm.ssTableMap[id].filePath)] = true
+		dropErr := lsm.dropSsTable(id)
+		if dropErr != nil && err == nil {
+			err = dropErr
+		}
+	}
+	lsm.ssTableMapLock.Unlock()
+
+	for dir := range dirs {
+		if err == nil {
+			err = lsm.fs.SyncDir(dir)
+		}
+	}
+
+	if err == nil && dropDeleted && newSt.deletedCount != 0 {
+		err = lsm.dropTombstones(currStId)
+	}
+	if err != nil {
+		return err
+	}
+
+	lsm.log.Pf(0, "merge %v -> %d done", ids, currStId)
+	return nil
+}
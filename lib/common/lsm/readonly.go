@@ -0,0 +1,193 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/irqlevel/naiv/lib/common/log"
+)
+
+var (
+	ErrReadOnly = fmt.Errorf("Lsm is read only")
+)
+
+const (
+	catchUpTimeoutMs = 1000
+)
+
+// openLsmReadOnly opens the tables and replays the log into memory, column
+// families are opened too if families is set.
+func openLsmReadOnly(log log.LogInterface, rootPath string, opts *LsmOptions, families bool) (*Lsm, error) {
+	lsm := newLsm(log, rootPath, nil, opts)
+	lsm.readOnly = true
+
+	err := lsm.openSsTables()
+	if err != nil {
+		log.Pf(0, "open tables error %v", err)
+		lsm.closeSsTables()
+		return nil, err
+	}
+
+	if families {
+		err = lsm.openFamilies()
+		if err != nil {
+			log.Pf(0, "open column families error %v", err)
+			lsm.closeSsTables()
+			lsm.closeFamilies()
+			return nil, err
+		}
+	}
+
+	logFile, err := lsm.fs.OpenFile(filepath.Join(rootPath, logFileName), os.O_RDONLY, 0600)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Pf(0, "open log error %v", err)
+			lsm.closeSsTables()
+			lsm.closeFamilies()
+			return nil, err
+		}
+		return lsm, nil
+	}
+	defer logFile.Close()
+
+	_, _, seq, err := lsm.readLog(logFile, lsm.nodeMap)
+	if err != nil {
+		log.Pf(0, "read log error %v", err)
+		lsm.closeSsTables()
+		lsm.closeFamilies()
+		return nil, err
+	}
+	if seq > lsm.seq {
+		lsm.seq = seq
+	}
+	return lsm, nil
+}
+
+// OpenLsmReadOnly opens a closed Lsm directory for reads. Nothing but a
+// missing LOCK file is written, the log is replayed into memory only. The
+// directory can't be opened for writing until the instance is closed.
+func OpenLsmReadOnly(log log.LogInterface, rootPath string, opts *LsmOptions) (*Lsm, error) {
+	log.Pf(0, "open read only")
+	lockFile, err := lockDirShared(lsmFS(opts), rootPath)
+	if err != nil {
+		log.Pf(0, "lock %s error %v", rootPath, err)
+		return nil, err
+	}
+
+	lsm, err := openLsmReadOnly(log, rootPath, opts, true)
+	if err != nil {
+		unlockDir(lockFile)
+		return nil, err
+	}
+	lsm.lockFile = lockFile
+	lsm.start()
+	return lsm, nil
+}
+
+// OpenLsmSecondary opens a directory which a primary instance may be
+// writing. Nothing is locked or written, tables and log written by the
+// primary are picked up every CatchUpInterval or by TryCatchUpWithPrimary.
+// Only the default column family is available.
+func OpenLsmSecondary(log log.LogInterface, rootPath string, opts *LsmOptions) (*Lsm, error) {
+	log.Pf(0, "open secondary")
+	lsm, err := openLsmReadOnly(log, rootPath, opts, false)
+	if err != nil {
+		return nil, err
+	}
+
+	interval := lsm.opts.CatchUpInterval
+	if interval == 0 {
+		interval = catchUpTimeoutMs * time.Millisecond
+	}
+	lsm.catchUpTimer = time.NewTicker(interval)
+	lsm.start()
+	return lsm, nil
+}
+
+// TryCatchUpWithPrimary reloads the log and the set of tables of a
+// secondary instance. The log is read first, so data moved from the log
+// into a table in between is found in one of them. On error the previous
+// view is kept.
+func (lsm *Lsm) TryCatchUpWithPrimary() error {
+	if lsm.catchUpTimer == nil {
+		return ErrReadOnly
+	}
+
+	nodeMap := make(map[string]*LsmNode)
+	seq := uint64(0)
+	logFile, err := lsm.fs.OpenFile(filepath.Join(lsm.rootPath, logFileName), os.O_RDONLY, 0600)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		// A record torn by a concurrent append ends the log
+		_, _, seq, err = lsm.readLog(logFile, nodeMap)
+		logFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	tables, err := lsm.findSsTables()
+	if err != nil {
+		return err
+	}
+
+	opened := make(map[int64]*SsTable)
+	for id, filePath := range tables {
+		info, err := lsm.fs.Stat(filePath)
+		if err != nil {
+			continue
+		}
+
+		lsm.ssTableMapLock.RLock()
+		st, ok := lsm.ssTableMap[id]
+		same := false
+		if ok {
+			stInfo, err := st.file.Stat()
+			same = err == nil && lsm.fs.SameFile(info, stInfo) && info.Size() == stInfo.Size()
+		}
+		lsm.ssTableMapLock.RUnlock()
+		if same {
+			continue
+		}
+
+		st, err = openSsTable(lsm.fs, lsm.log, filePath, lsm.codec())
+		if err != nil {
+			// Removed or still being written by the primary
+			continue
+		}
+		opened[id] = st
+	}
+
+	lsm.nodeMapLock.Lock()
+	defer lsm.nodeMapLock.Unlock()
+
+	lsm.ssTableMapLock.Lock()
+	defer lsm.ssTableMapLock.Unlock()
+
+	for id, st := range lsm.ssTableMap {
+		_, present := tables[id]
+		_, reopened := opened[id]
+		if !present || reopened {
+			st.Close()
+			delete(lsm.ssTableMap, id)
+		}
+	}
+
+	for id, st := range opened {
+		lsm.addSsTable(id, st)
+		if st.maxSeq > lsm.seq {
+			lsm.seq = st.maxSeq
+		}
+	}
+	if seq > lsm.seq {
+		lsm.seq = seq
+	}
+
+	lsm.nodeMap = nodeMap
+	return nil
+}
@@ -0,0 +1,153 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrNoSpace              = fmt.Errorf("Out of space")
+	tmpTableFileNamePattern = regexp.MustCompile(`^lsm\_([0-9]+)\.sstable\.tmp$`)
+)
+
+const (
+	// spaceRetryInterval is how often a write checks whether space was
+	// freed while the Lsm is out of space
+	spaceRetryInterval = 100 * time.Millisecond
+)
+
+// recordSize is the size of a log record of key and value.
+func recordSize(key string, value string) int64 {
+	return (&LsmNode{key: key, value: value}).diskSize()
+}
+
+func memorySize(nodeMap map[string]*LsmNode) int64 {
+	size := int64(0)
+	for _, node := range nodeMap {
+		for ; node != nil; node = node.older {
+			size += node.diskSize()
+		}
+	}
+	return size
+}
+
+func isNoSpace(err error) bool {
+	return err == ErrNoSpace || errors.Is(err, syscall.ENOSPC)
+}
+
+// spaceError turns running out of space into ErrNoSpace and stops writes
+// until space is freed. Other errors are returned as is.
+func (lsm *Lsm) spaceError(err error) error {
+	if !isNoSpace(err) {
+		return err
+	}
+	if atomic.CompareAndSwapInt32(&lsm.root.noSpace, 0, 1) {
+		lsm.root.log.Pf(0, "out of space, writes stopped: %v", err)
+	}
+	return ErrNoSpace
+}
+
+// usedSpace sums the log and the tables of the Lsm and its column families.
+// Must be called on the root with nodeMapLock held.
+func (lsm *Lsm) usedSpace() int64 {
+	used := lsm.logSize
+	add := func(l *Lsm) {
+		l.ssTableMapLock.RLock()
+		defer l.ssTableMapLock.RUnlock()
+		for _, st := range l.ssTableMap {
+			used += st.size
+		}
+	}
+
+	add(lsm)
+	for _, family := range lsm.families {
+		add(family)
+	}
+	return used
+}
+
+// checkFreeSpace fails with ErrNoSpace if writing size bytes would cut into
+// FreeSpaceReserve on any path the Lsm writes to.
+func (lsm *Lsm) checkFreeSpace(size int64) error {
+	root := lsm.root
+	if root.opts.FreeSpaceReserve == 0 {
+		return nil
+	}
+
+	for _, dir := range root.tableDirs() {
+		free, err := root.fs.FreeSpace(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if free-size < root.opts.FreeSpaceReserve {
+			return ErrNoSpace
+		}
+	}
+	return nil
+}
+
+// checkWriteSpace fails with ErrNoSpace if a write of size bytes doesn't
+// fit into the quota or the reserve. Deletes are let through the quota, so
+// space can be won back. Must be called on the root with nodeMapLock held
+// for writing.
+func (lsm *Lsm) checkWriteSpace(size int64, deletesOnly bool) error {
+	if atomic.LoadInt32(&lsm.noSpace) != 0 {
+		err := lsm.recoverSpace()
+		if err != nil {
+			return err
+		}
+	}
+
+	if lsm.opts.SpaceQuota != 0 && !deletesOnly && lsm.usedSpace()+size > lsm.opts.SpaceQuota {
+		return ErrNoSpace
+	}
+	return lsm.spaceError(lsm.checkFreeSpace(size))
+}
+
+// recoverSpace retries the flush which ran out of space once free space is
+// back above the reserve, writes go on if it succeeds. It is tried at most
+// every spaceRetryInterval. Must be called on the root with nodeMapLock held
+// for writing.
+func (lsm *Lsm) recoverSpace() error {
+	if time.Since(lsm.noSpaceChecked) < spaceRetryInterval {
+		return ErrNoSpace
+	}
+	lsm.noSpaceChecked = time.Now()
+
+	err := lsm.checkFreeSpace(0)
+	if err != nil {
+		return lsm.spaceError(err)
+	}
+
+	err = lsm.compact()
+	if err != nil {
+		return lsm.spaceError(err)
+	}
+
+	atomic.StoreInt32(&lsm.noSpace, 0)
+	lsm.log.Pf(0, "space recovered, writes resumed")
+	return nil
+}
+
+// removeTmpSsTables removes what a crash left of tables being written.
+func (lsm *Lsm) removeTmpSsTables() {
+	for _, dir := range lsm.tableDirs() {
+		ids, err := listFileIndexes(lsm.fs, dir, tmpTableFileNamePattern)
+		if err != nil {
+			continue
+		}
+		for _, id := range ids {
+			filePath := getSsTablePathIn(dir, id) + ".tmp"
+			lsm.log.Pf(0, "remove %s", filePath)
+			lsm.fs.Remove(filePath)
+		}
+	}
+}
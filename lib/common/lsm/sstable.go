@@ -3,15 +3,19 @@ package lsm
 import (
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"sort"
 	"sync"
 
 	log "github.com/irqlevel/naiv/lib/common/log"
+	"github.com/irqlevel/naiv/lib/common/vfs"
 )
 
 var (
-	ErrDeleted = fmt.Errorf("Deleted")
+	ErrDeleted     = fmt.Errorf("Deleted")
+	ErrTableClosed = fmt.Errorf("Table closed")
 )
 
 const (
@@ -20,46 +24,83 @@ const (
 
 type SsTable struct {
 	filePath string
-	file     *os.File
+	file     vfs.File
+	fs       vfs.FS
 	lock     sync.RWMutex
 
 	keyToOffset map[string]int64
-	keys        []string
+	// keyToCount is the number of nodes before each indexed key
+	keyToCount map[string]int64
+	keys       []string
 
 	minKey *string
 	maxKey *string
-	log    log.LogInterface
+	maxSeq uint64
+	// minTimestamp and maxTimestamp bound the write times of the nodes,
+	// zero if none has one
+	minTimestamp int64
+	maxTimestamp int64
+	size         int64
+	count        int64
+	// deletedCount is the number of tombstones
+	deletedCount int64
+	log          log.LogInterface
+	onErase      func(filePath string)
+
+	codec nodeCodec
+	// cipher is nil for a plain text table, nodes start at dataOffset
+	cipher     *fileCipher
+	dataOffset int64
 }
 
 func (st *SsTable) index() error {
-	file, err := os.OpenFile(st.filePath, os.O_RDONLY, 0600)
+	file, err := st.fs.OpenFile(st.filePath, os.O_RDONLY, 0600)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
+	st.cipher, st.dataOffset, err = readFileHeader(file, st.codec.keys)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(st.dataOffset, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+
 	st.minKey = nil
 	st.maxKey = nil
+	st.maxSeq = 0
+	st.minTimestamp = 0
+	st.maxTimestamp = 0
+	st.size = 0
+	st.count = 0
+	st.deletedCount = 0
 
 	i := int64(0)
+	indexDue := false
+	var prevKey *string
 
 	st.keys = make([]string, 0)
 	st.keyToOffset = make(map[string]int64)
+	st.keyToCount = make(map[string]int64)
 
+	nr := st.newNodeReader(file, st.dataOffset)
 	for {
-		node := new(LsmNode)
-		offset, err := file.Seek(0, os.SEEK_CUR)
-		if err != nil {
-			return err
-		}
-
-		err = node.ReadFrom(file)
+		offset := nr.offset
+		node, err := nr.next()
 		if err != nil {
 			if err == io.EOF {
+				st.size = offset
 				break
 			}
 			return err
 		}
+		st.count++
+		if node.deleted {
+			st.deletedCount++
+		}
 
 		if st.minKey == nil {
 			st.minKey = &node.key
@@ -73,10 +114,31 @@ func (st *SsTable) index() error {
 			st.maxKey = &node.key
 		}
 
+		if node.seq > st.maxSeq {
+			st.maxSeq = node.seq
+		}
+
+		if node.timestamp > 0 {
+			if st.minTimestamp == 0 || node.timestamp < st.minTimestamp {
+				st.minTimestamp = node.timestamp
+			}
+			if node.timestamp > st.maxTimestamp {
+				st.maxTimestamp = node.timestamp
+			}
+		}
+
+		// An index block starts at the newest version of a key, so the
+		// versions of a key are never split across blocks
 		if i%keysPerIndex == 0 {
+			indexDue = true
+		}
+		if indexDue && (prevKey == nil || node.key != *prevKey) {
 			st.keys = append(st.keys, node.key)
 			st.keyToOffset[node.key] = offset
+			st.keyToCount[node.key] = i
+			indexDue = false
 		}
+		prevKey = &node.key
 		i++
 	}
 
@@ -84,11 +146,17 @@ func (st *SsTable) index() error {
 	return nil
 }
 
-func newSsTable(log log.LogInterface, filePath string, nodeMap map[string]*LsmNode) (*SsTable, error) {
+func newSsTable(fs vfs.FS, log log.LogInterface, filePath string, nodeMap map[string]*LsmNode,
+	throttle *ioThrottle, codec nodeCodec) (*SsTable, error) {
 	st := new(SsTable)
 	st.filePath = filePath
+	st.fs = fs
 	st.log = log
-	file, err := os.OpenFile(st.filePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	st.codec = codec
+	// The table is written aside and renamed into place once it is
+	// durable, so no reader ever finds a partial one
+	tmpFilePath := filePath + ".tmp"
+	file, err := fs.OpenFile(tmpFilePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
 		log.Pf(0, "Create table %s error %v", st.filePath, err)
 		return nil, err
@@ -102,40 +170,65 @@ func newSsTable(log log.LogInterface, filePath string, nodeMap map[string]*LsmNo
 	}
 	sort.Strings(keys)
 
+	w := &countingWriter{w: throttle.writer(file)}
+	c, err := writeFileHeader(w, st.codec.keys)
+	if err != nil {
+		file.Close()
+		fs.Remove(tmpFilePath)
+		return nil, err
+	}
+
+	// Every version of a key is written, newest first
 	for _, key := range keys {
-		node := nodeMap[key]
-		err = node.WriteTo(file)
-		if err != nil {
-			file.Close()
-			os.Remove(st.filePath)
-			return nil, err
+		for node := nodeMap[key]; node != nil; node = node.older {
+			err = node.writeTo(w, c, w.n)
+			if err != nil {
+				file.Close()
+				fs.Remove(tmpFilePath)
+				return nil, err
+			}
 		}
 	}
 
-	/*
-		err = file.Sync()
-		if err != nil {
-			file.Close()
-			os.Remove(st.filePath)
-			return nil, err
-		}
-	*/
+	// The table replaces log records, it must be durable before they go
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		fs.Remove(tmpFilePath)
+		return nil, err
+	}
+
+	err = fs.Rename(tmpFilePath, filePath)
+	if err != nil {
+		file.Close()
+		fs.Remove(tmpFilePath)
+		return nil, err
+	}
+
+	err = fs.SyncDir(filepath.Dir(filePath))
+	if err != nil {
+		file.Close()
+		fs.Remove(filePath)
+		return nil, err
+	}
 
 	err = st.index()
 	if err != nil {
 		file.Close()
-		os.Remove(st.filePath)
+		fs.Remove(filePath)
 		return nil, err
 	}
 	st.file = file
 	return st, nil
 }
 
-func openSsTable(log log.LogInterface, filePath string) (*SsTable, error) {
+func openSsTable(fs vfs.FS, log log.LogInterface, filePath string, codec nodeCodec) (*SsTable, error) {
 	st := new(SsTable)
 	st.filePath = filePath
+	st.fs = fs
 	st.log = log
-	file, err := os.OpenFile(st.filePath, os.O_RDWR, 0600)
+	st.codec = codec
+	file, err := fs.OpenFile(st.filePath, os.O_RDONLY, 0600)
 	if err != nil {
 		log.Pf(0, "Open table %s error %v", st.filePath, err)
 		return nil, err
@@ -150,26 +243,37 @@ func openSsTable(log log.LogInterface, filePath string) (*SsTable, error) {
 }
 
 func (st *SsTable) Get(key string) (string, error) {
+	node, err := st.getAt(key, math.MaxInt64)
+	if err != nil {
+		return "", err
+	}
+	if node.deleted {
+		return "", ErrDeleted
+	}
+	return node.value, nil
+}
+
+// getAt returns the newest version of key written at or before ts, which
+// may be a tombstone. Versions of a key follow each other newest first.
+func (st *SsTable) getAt(key string, ts int64) (*LsmNode, error) {
 	st.lock.RLock()
 	defer st.lock.RUnlock()
 
 	if st.minKey != nil && key < *st.minKey {
-		return "", ErrNotFound
+		return nil, ErrNotFound
 	}
 
 	if st.maxKey != nil && key > *st.maxKey {
-		return "", ErrNotFound
+		return nil, ErrNotFound
 	}
 
-	file, err := os.OpenFile(st.filePath, os.O_RDONLY, 0600)
-	if err != nil {
-		return "", err
+	if st.file == nil {
+		return nil, ErrTableClosed
 	}
-	defer file.Close()
 
 	//st.log.Pf(0, "%s keys %d", st.filePath, len(st.keys))
 
-	offset := int64(0)
+	offset := st.dataOffset
 	if len(st.keys) > 0 {
 		keyIndex := sort.SearchStrings(st.keys, key)
 		if keyIndex > 0 {
@@ -177,40 +281,49 @@ func (st *SsTable) Get(key string) (string, error) {
 		}
 
 		offset = st.keyToOffset[st.keys[keyIndex]]
-		_, err = file.Seek(offset, os.SEEK_SET)
-		if err != nil {
-			return "", err
-		}
 	}
 
+	// Read through the open file, so the table stays readable even if
+	// another instance removes or replaces it
+	nr := st.newNodeReader(io.NewSectionReader(st.file, offset, st.size-offset), offset)
 	for {
-		offset, err = file.Seek(0, os.SEEK_CUR)
-		if err != nil {
-			return "", err
-		}
-
-		//st.log.Pf(0, "lookup %s at %d for key %s", st.filePath, offset, key)
-		node := new(LsmNode)
-		err = node.ReadFrom(file)
+		//st.log.Pf(0, "lookup %s at %d for key %s", st.filePath, nr.offset, key)
+		node, err := nr.next()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return "", err
+			return nil, err
 		}
-		if node.key == key {
-			if node.deleted {
-				return "", ErrDeleted
-			}
-
-			return node.value, nil
+		if node.key == key && node.timestamp <= ts {
+			return node, nil
 		}
 		if node.key > key {
 			break
 		}
 	}
 
-	return "", ErrNotFound
+	return nil, ErrNotFound
+}
+
+// newNodeReader reads the nodes of the table from r, which is at offset.
+func (st *SsTable) newNodeReader(r io.Reader, offset int64) *nodeReader {
+	return &nodeReader{r: r, filePath: st.filePath, offset: offset, cipher: st.cipher, limits: st.codec.limits}
+}
+
+// reopen switches the table to the same file moved to filePath.
+func (st *SsTable) reopen(filePath string) error {
+	file, err := st.fs.OpenFile(filePath, os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.file.Close()
+	st.file = file
+	st.filePath = filePath
+	return nil
 }
 
 func (st *SsTable) Close() {
@@ -222,128 +335,20 @@ func (st *SsTable) Close() {
 	st.filePath = ""
 }
 
-func (st *SsTable) Erase() {
+// Erase closes the table and removes its file.
+func (st *SsTable) Erase() error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
 	st.file.Close()
 	st.log.Pf(0, "erase %s", st.filePath)
-	os.Remove(st.filePath)
-	st.file = nil
-	st.filePath = ""
-}
-
-func (currSt *SsTable) Merge(prevSt *SsTable, tmpFilePath string) error {
-	prevSt.lock.RLock()
-	defer prevSt.lock.RUnlock()
-
-	currSt.lock.RLock()
-	defer currSt.lock.RUnlock()
-
-	var prevFile, currFile, tmpFile *os.File
-	var err error
-
-	defer func() {
-		if prevFile != nil {
-			prevFile.Close()
-		}
-		if currFile != nil {
-			currFile.Close()
-		}
-
-		if err != nil {
-			if tmpFile != nil {
-				tmpFile.Close()
-				os.Remove(tmpFilePath)
-			}
-		} else {
-			if tmpFile != nil {
-				tmpFile.Close()
-			}
-		}
-	}()
-
-	prevFile, err = os.OpenFile(prevSt.filePath, os.O_RDONLY, 0600)
-	if err != nil {
-		return err
-	}
-
-	currFile, err = os.OpenFile(currSt.filePath, os.O_RDONLY, 0600)
-	if err != nil {
-		return err
-	}
-
-	tmpFile, err = os.OpenFile(tmpFilePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	err := st.fs.Remove(st.filePath)
 	if err != nil {
-		return err
+		st.log.Pf(0, "remove %s error %v", st.filePath, err)
 	}
-
-	var prevNode, currNode, newNode *LsmNode
-
-	for {
-		if prevNode == nil && prevFile != nil {
-			prevNode = new(LsmNode)
-			err = prevNode.ReadFrom(prevFile)
-			if err != nil {
-				if err != io.EOF {
-					return err
-				}
-				prevFile.Close()
-				prevFile = nil
-				prevNode = nil
-				err = nil
-			}
-		}
-
-		if currNode == nil && currFile != nil {
-			currNode = new(LsmNode)
-			err = currNode.ReadFrom(currFile)
-			if err != nil {
-				if err != io.EOF {
-					return err
-				}
-				currFile.Close()
-				currFile = nil
-				currNode = nil
-				err = nil
-			}
-		}
-
-		if currNode == nil && prevNode == nil {
-			break
-		}
-
-		if currNode != nil && prevNode == nil {
-			newNode = currNode
-			currNode = nil
-		} else if prevNode != nil && currNode == nil {
-			newNode = prevNode
-			prevNode = nil
-		} else {
-			if prevNode.key == currNode.key {
-				newNode = currNode
-				currNode = nil
-				prevNode = nil
-			} else if prevNode.key < currNode.key {
-				newNode = prevNode
-				prevNode = nil
-			} else {
-				newNode = currNode
-				currNode = nil
-			}
-		}
-
-		err = newNode.WriteTo(tmpFile)
-		if err != nil {
-			return err
-		}
+	if st.onErase != nil {
+		st.onErase(st.filePath)
 	}
-
-	/*
-		err = tmpFile.Sync()
-		if err != nil {
-			return err
-		}
-	*/
-
-	return nil
+	st.file = nil
+	st.filePath = ""
+	return err
 }
@@ -0,0 +1,109 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/irqlevel/naiv/lib/common/vfs"
+)
+
+var (
+	ErrSsTableWriterUnsorted = fmt.Errorf("Keys are not sorted")
+	ErrSsTableWriterClosed   = fmt.Errorf("Writer already closed")
+)
+
+// SsTableWriter builds a table file offline from keys added in strictly
+// increasing order. The result can be passed to Lsm.IngestExternalFiles.
+type SsTableWriter struct {
+	filePath string
+	fs       vfs.FS
+	file     vfs.File
+	lastKey  *string
+	count    int64
+}
+
+func NewSsTableWriter(filePath string) (*SsTableWriter, error) {
+	w := new(SsTableWriter)
+	w.filePath = filePath
+	w.fs = vfs.Default
+	file, err := w.fs.OpenFile(w.filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w.file = file
+	return w, nil
+}
+
+func (w *SsTableWriter) add(node *LsmNode) error {
+	if w.file == nil {
+		return ErrSsTableWriterClosed
+	}
+
+	if node.key == "" {
+		return ErrEmptyKey
+	}
+
+	if w.lastKey != nil && node.key <= *w.lastKey {
+		return ErrSsTableWriterUnsorted
+	}
+
+	err := defaultSizeLimits.check(node.key, node.value)
+	if err != nil {
+		return err
+	}
+
+	err = node.WriteTo(w.file)
+	if err != nil {
+		return err
+	}
+	w.lastKey = &node.key
+	w.count++
+	return nil
+}
+
+func (w *SsTableWriter) Set(key string, value string) error {
+	if value == "" {
+		return ErrEmptyValue
+	}
+	return w.add(newLsmNode(key, value))
+}
+
+func (w *SsTableWriter) Delete(key string) error {
+	n := newLsmNode(key, "")
+	n.deleted = true
+	return w.add(n)
+}
+
+func (w *SsTableWriter) Count() int64 {
+	return w.count
+}
+
+// Finish syncs and closes the table file.
+func (w *SsTableWriter) Finish() error {
+	if w.file == nil {
+		return ErrSsTableWriterClosed
+	}
+
+	err := w.file.Sync()
+	if err != nil {
+		w.Abort()
+		return err
+	}
+
+	err = w.file.Close()
+	w.file = nil
+	if err != nil {
+		w.fs.Remove(w.filePath)
+	}
+	return err
+}
+
+// Abort closes and removes the unfinished table file.
+func (w *SsTableWriter) Abort() {
+	if w.file == nil {
+		return
+	}
+	w.file.Close()
+	w.file = nil
+	w.fs.Remove(w.filePath)
+}
@@ -0,0 +1,171 @@
+package lsm
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrWriteStalled = fmt.Errorf("Write stalled by flush and merge debt")
+)
+
+const (
+	defaultSlowdownDelay = time.Millisecond
+	stallRetryInterval   = 100 * time.Millisecond
+)
+
+// WriteStallOptions bound the debt of flushes and merges that fell behind.
+// A write is delayed once any soft threshold is reached and blocked while a
+// hard one is, a zero threshold is off.
+type WriteStallOptions struct {
+	// TableCount is the number of tables of the busiest column family,
+	// each one is probed by reads
+	SoftTableCount int
+	HardTableCount int
+	// MemoryNodeCount is the number of memory nodes over the flush size,
+	// they pile up while flushes fail
+	SoftMemoryNodeCount int
+	HardMemoryNodeCount int
+	// PendingCompactionBytes is the size of the tables the compaction
+	// policy still wants to merge or drop
+	SoftPendingCompactionBytes int64
+	HardPendingCompactionBytes int64
+
+	// SlowdownDelay is how long a write is delayed at a soft threshold,
+	// zero means one millisecond
+	SlowdownDelay time.Duration
+	// StopTimeout is how long a write waits at a hard threshold before it
+	// fails with ErrWriteStalled, zero means until the debt is paid
+	StopTimeout time.Duration
+}
+
+type writeDebt struct {
+	tableCount             int
+	memoryNodeCount        int
+	pendingCompactionBytes int64
+}
+
+// pendingCompactionBytes sums the tables of the next step of the compaction
+// policy. Must be called with ssTableMapLock held.
+func (lsm *Lsm) pendingCompactionBytes() int64 {
+	c := lsm.compactionPolicy().Pick(lsm.tableStats())
+	if c == nil {
+		return 0
+	}
+
+	size := int64(0)
+	for _, id := range append(append([]int64{}, c.Merge...), c.Drop...) {
+		if st, ok := lsm.ssTableMap[id]; ok {
+			size += st.size
+		}
+	}
+	return size
+}
+
+// debt measures the root and every column family. Must be called on the
+// root with nodeMapLock held for writing.
+func (lsm *Lsm) debt() writeDebt {
+	var d writeDebt
+	add := func(l *Lsm) {
+		if n := len(l.nodeMap) - maxMemoryNodeCount; n > 0 {
+			d.memoryNodeCount += n
+		}
+
+		l.ssTableMapLock.RLock()
+		defer l.ssTableMapLock.RUnlock()
+		if len(l.ssTableMap) > d.tableCount {
+			d.tableCount = len(l.ssTableMap)
+		}
+		if lsm.opts.WriteStall.SoftPendingCompactionBytes != 0 ||
+			lsm.opts.WriteStall.HardPendingCompactionBytes != 0 {
+			d.pendingCompactionBytes += l.pendingCompactionBytes()
+		}
+	}
+
+	add(lsm)
+	for _, family := range lsm.families {
+		add(family)
+	}
+	return d
+}
+
+func overThreshold(value int64, threshold int64) bool {
+	return threshold != 0 && value >= threshold
+}
+
+func (o *WriteStallOptions) soft(d writeDebt) bool {
+	return overThreshold(int64(d.tableCount), int64(o.SoftTableCount)) ||
+		overThreshold(int64(d.memoryNodeCount), int64(o.SoftMemoryNodeCount)) ||
+		overThreshold(d.pendingCompactionBytes, o.SoftPendingCompactionBytes)
+}
+
+func (o *WriteStallOptions) hard(d writeDebt) bool {
+	return overThreshold(int64(d.tableCount), int64(o.HardTableCount)) ||
+		overThreshold(int64(d.memoryNodeCount), int64(o.HardMemoryNodeCount)) ||
+		overThreshold(d.pendingCompactionBytes, o.HardPendingCompactionBytes)
+}
+
+func (o *WriteStallOptions) enabled() bool {
+	return o.SoftTableCount != 0 || o.HardTableCount != 0 ||
+		o.SoftMemoryNodeCount != 0 || o.HardMemoryNodeCount != 0 ||
+		o.SoftPendingCompactionBytes != 0 || o.HardPendingCompactionBytes != 0
+}
+
+// payDebt retries the flushes which fell behind and wakes the merges, they
+// run in the background while the write waits. Must be called on the root
+// with nodeMapLock held for writing.
+func (lsm *Lsm) payDebt() {
+	err := lsm.compact()
+	if err != nil {
+		lsm.backgroundError("compact", err)
+	}
+	lsm.scheduleMerge()
+}
+
+// stallWrite delays or blocks a write while the debt is over the
+// thresholds of WriteStall. nodeMapLock is released while waiting. Must be
+// called on the root with nodeMapLock held for writing.
+func (lsm *Lsm) stallWrite() error {
+	o := &lsm.opts.WriteStall
+	if !o.enabled() {
+		return nil
+	}
+
+	d := lsm.debt()
+	if !o.soft(d) && !o.hard(d) {
+		return nil
+	}
+
+	begin := time.Now()
+	defer func() { atomic.AddInt64(&lsm.counters.stallTime, int64(time.Since(begin))) }()
+
+	if !o.hard(d) {
+		delay := o.SlowdownDelay
+		if delay == 0 {
+			delay = defaultSlowdownDelay
+		}
+		atomic.AddInt64(&lsm.counters.slowdowns, 1)
+		lsm.nodeMapLock.Unlock()
+		time.Sleep(delay)
+		lsm.nodeMapLock.Lock()
+		return nil
+	}
+
+	atomic.AddInt64(&lsm.counters.stops, 1)
+	lsm.log.Pf(0, "write stopped tables %d memory nodes %d pending compaction bytes %d",
+		d.tableCount, d.memoryNodeCount, d.pendingCompactionBytes)
+	for {
+		lsm.payDebt()
+		if !o.hard(lsm.debt()) {
+			return nil
+		}
+		if lsm.closing || (o.StopTimeout != 0 && time.Since(begin) >= o.StopTimeout) {
+			return ErrWriteStalled
+		}
+
+		lsm.nodeMapLock.Unlock()
+		time.Sleep(stallRetryInterval)
+		lsm.nodeMapLock.Lock()
+	}
+}
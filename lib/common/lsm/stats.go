@@ -0,0 +1,153 @@
+package lsm
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/irqlevel/naiv/lib/common/sequence"
+)
+
+const (
+	// latencySamples is how many of the newest latencies are kept
+	latencySamples = 4096
+)
+
+type LsmTableStats struct {
+	Id             int64
+	Path           string
+	Size           int64
+	Count          int64
+	MinKey         string
+	MaxKey         string
+	TombstoneRatio float64
+	// KeyId is the master key the table is encrypted with, empty for a
+	// plain text table
+	KeyId string
+	// MinTimestamp and MaxTimestamp are the oldest and newest write times
+	// of the records, zero if unknown
+	MinTimestamp int64
+	MaxTimestamp int64
+}
+
+// LsmStats is a snapshot of the counters, the latency sequences are shared
+// with the engine and hold the newest latencySamples samples. Latencies are
+// in microseconds.
+type LsmStats struct {
+	Puts        int64
+	Gets        int64
+	Deletes     int64
+	MemoryHits  int64
+	TableProbes int64
+	LogBytes    int64
+	TableBytes  int64
+	Flushes     int64
+	Merges      int64
+	// Slowdowns and Stops count writes delayed at a soft and blocked at a
+	// hard WriteStall threshold, StallTime is the time they waited
+	Slowdowns int64
+	Stops     int64
+	StallTime time.Duration
+	// OutOfSpace is set while writes fail with ErrNoSpace
+	OutOfSpace bool
+
+	SetLatency    *sequence.Sequence
+	GetLatency    *sequence.Sequence
+	DeleteLatency *sequence.Sequence
+	FlushDuration *sequence.Sequence
+	MergeDuration *sequence.Sequence
+
+	Tables []LsmTableStats
+}
+
+type lsmCounters struct {
+	puts        int64
+	gets        int64
+	deletes     int64
+	memoryHits  int64
+	tableProbes int64
+	logBytes    int64
+	tableBytes  int64
+	flushes     int64
+	merges      int64
+	slowdowns   int64
+	stops       int64
+	stallTime   int64
+
+	setLatency    *sequence.Sequence
+	getLatency    *sequence.Sequence
+	deleteLatency *sequence.Sequence
+	flushDuration *sequence.Sequence
+	mergeDuration *sequence.Sequence
+}
+
+func newLsmCounters() *lsmCounters {
+	c := new(lsmCounters)
+	c.setLatency = sequence.NewBoundedSequence(latencySamples)
+	c.getLatency = sequence.NewBoundedSequence(latencySamples)
+	c.deleteLatency = sequence.NewBoundedSequence(latencySamples)
+	c.flushDuration = sequence.NewBoundedSequence(latencySamples)
+	c.mergeDuration = sequence.NewBoundedSequence(latencySamples)
+	return c
+}
+
+func sinceUs(begin time.Time) float64 {
+	return float64(time.Since(begin).Nanoseconds()) / 1000
+}
+
+func sinceDuration(begin time.Time) time.Duration {
+	return time.Since(begin)
+}
+
+func (lsm *Lsm) Stats() *LsmStats {
+	c := lsm.counters
+	s := &LsmStats{
+		Puts:          atomic.LoadInt64(&c.puts),
+		Gets:          atomic.LoadInt64(&c.gets),
+		Deletes:       atomic.LoadInt64(&c.deletes),
+		MemoryHits:    atomic.LoadInt64(&c.memoryHits),
+		TableProbes:   atomic.LoadInt64(&c.tableProbes),
+		LogBytes:      atomic.LoadInt64(&c.logBytes),
+		TableBytes:    atomic.LoadInt64(&c.tableBytes),
+		Flushes:       atomic.LoadInt64(&c.flushes),
+		Merges:        atomic.LoadInt64(&c.merges),
+		Slowdowns:     atomic.LoadInt64(&c.slowdowns),
+		Stops:         atomic.LoadInt64(&c.stops),
+		StallTime:     time.Duration(atomic.LoadInt64(&c.stallTime)),
+		OutOfSpace:    atomic.LoadInt32(&lsm.root.noSpace) != 0,
+		SetLatency:    c.setLatency,
+		GetLatency:    c.getLatency,
+		DeleteLatency: c.deleteLatency,
+		FlushDuration: c.flushDuration,
+		MergeDuration: c.mergeDuration,
+	}
+
+	lsm.ssTableMapLock.RLock()
+	defer lsm.ssTableMapLock.RUnlock()
+
+	s.Tables = lsm.tableStats()
+	return s
+}
+
+// tableStats describes the tables oldest first. Must be called with
+// ssTableMapLock held.
+func (lsm *Lsm) tableStats() []LsmTableStats {
+	tables := make([]LsmTableStats, 0, len(lsm.ssTableMap))
+	for id, st := range lsm.ssTableMap {
+		ts := LsmTableStats{Id: id, Path: st.filePath, Size: st.size, Count: st.count,
+			MinTimestamp: st.minTimestamp, MaxTimestamp: st.maxTimestamp}
+		if st.minKey != nil {
+			ts.MinKey = *st.minKey
+			ts.MaxKey = *st.maxKey
+		}
+		if st.cipher != nil {
+			ts.KeyId = st.cipher.keyId
+		}
+		if st.count != 0 {
+			ts.TombstoneRatio = float64(st.deletedCount) / float64(st.count)
+		}
+		tables = append(tables, ts)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Id < tables[j].Id })
+	return tables
+}
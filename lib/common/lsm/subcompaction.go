@@ -0,0 +1,139 @@
+package lsm
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// defaultSubcompactionMinSize is the size of input below which a merge
+	// is not split when SubcompactionMinSize is zero
+	defaultSubcompactionMinSize = 64 << 20
+)
+
+// subcompactionBounds splits a merge of tables of size bytes into up to
+// MaxSubcompactions shards of keys. The bounds are taken from the sparse
+// indexes, an index key starts a key together with all of its versions.
+// None are returned if the merge is not worth splitting.
+func (lsm *Lsm) subcompactionBounds(tables []*SsTable, size int64) []string {
+	minSize := lsm.opts.SubcompactionMinSize
+	if minSize == 0 {
+		minSize = defaultSubcompactionMinSize
+	}
+	shards := lsm.opts.MaxSubcompactions
+	if int64(shards) > size/minSize {
+		shards = int(size / minSize)
+	}
+	if shards < 2 {
+		return nil
+	}
+
+	keys := make([]string, 0)
+	for _, st := range tables {
+		keys = append(keys, st.keys...)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	bounds := make([]string, 0, shards-1)
+	prev := keys[0]
+	for i := 1; i < shards; i++ {
+		key := keys[i*len(keys)/shards]
+		if key > prev {
+			bounds = append(bounds, key)
+			prev = key
+		}
+	}
+	return bounds
+}
+
+// subcompact merges tables, ordered newest first, one shard between bounds
+// per goroutine into tables with new ids. The outputs are written aside and
+// installed together once every shard is done, so readers see either all
+// of them or none. The new ids are newer than any table, so no table newer
+// than the inputs may hold their keys. Returns the ids of the outputs which
+// aren't empty. Must be called with ssTableMapLock held.
+func (lsm *Lsm) subcompact(tables []*SsTable, bounds []string, size int64, dropDeleted bool) ([]int64, error) {
+	n := len(bounds) + 1
+	ids := make([]int64, n)
+	paths := make([]string, n)
+	for i := range ids {
+		ids[i] = atomic.AddInt64(&lsm.time, 1)
+		paths[i] = getSsTablePathIn(lsm.dataPathFor(ids[i], size/int64(n)), ids[i])
+	}
+
+	outputs := make([]*SsTable, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range ids {
+		start, end := "", ""
+		if i > 0 {
+			start = bounds[i-1]
+		}
+		if i < len(bounds) {
+			end = bounds[i]
+		}
+
+		wg.Add(1)
+		go func(i int, start string, end string) {
+			defer wg.Done()
+			outputs[i], errs[i] = lsm.mergeTables(tables, paths[i]+".tmp", dropDeleted, start, end)
+		}(i, start, end)
+	}
+	wg.Wait()
+
+	var err error
+	for _, shardErr := range errs {
+		if shardErr != nil {
+			err = shardErr
+			break
+		}
+	}
+
+	if err == nil {
+		for i, st := range outputs {
+			if st == nil {
+				continue
+			}
+			err = lsm.fs.Rename(paths[i]+".tmp", paths[i])
+			if err == nil {
+				err = lsm.fs.SyncDir(filepath.Dir(paths[i]))
+			}
+			if err == nil {
+				err = st.reopen(paths[i])
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	// Outputs already renamed hold the same data as the inputs, removing
+	// them leaves the inputs as they were
+	if err != nil {
+		for i, st := range outputs {
+			if st == nil {
+				continue
+			}
+			st.Close()
+			lsm.fs.Remove(paths[i] + ".tmp")
+			lsm.fs.Remove(paths[i])
+		}
+		return nil, err
+	}
+
+	outIds := make([]int64, 0, n)
+	for i, st := range outputs {
+		if st == nil {
+			continue
+		}
+		atomic.AddInt64(&lsm.counters.tableBytes, st.size)
+		lsm.addSsTable(ids[i], st)
+		outIds = append(outIds, ids[i])
+	}
+	return outIds, nil
+}
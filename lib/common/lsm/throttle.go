@@ -0,0 +1,40 @@
+package lsm
+
+import (
+	"io"
+
+	"github.com/irqlevel/naiv/lib/common/ratelimit"
+)
+
+// ioThrottle charges table writes to the rate limiter, a nil throttle or
+// limiter does not limit anything.
+type ioThrottle struct {
+	limiter  *ratelimit.RateLimiter
+	priority ratelimit.Priority
+}
+
+type throttledWriter struct {
+	w        io.Writer
+	throttle *ioThrottle
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	tw.throttle.limiter.Request(int64(len(p)), tw.throttle.priority)
+	return tw.w.Write(p)
+}
+
+func (t *ioThrottle) writer(w io.Writer) io.Writer {
+	if t == nil || t.limiter == nil {
+		return w
+	}
+	return &throttledWriter{w: w, throttle: t}
+}
+
+// Flushes go first as writers wait for them
+func (lsm *Lsm) flushThrottle() *ioThrottle {
+	return &ioThrottle{limiter: lsm.opts.RateLimiter, priority: ratelimit.PriorityHigh}
+}
+
+func (lsm *Lsm) mergeThrottle() *ioThrottle {
+	return &ioThrottle{limiter: lsm.opts.RateLimiter, priority: ratelimit.PriorityLow}
+}
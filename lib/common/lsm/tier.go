@@ -0,0 +1,186 @@
+package lsm
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// DataPath is a directory tables are kept in. TargetSize is how many bytes
+// of tables it should hold, zero means no limit.
+type DataPath struct {
+	Path       string
+	TargetSize int64
+}
+
+func getSsTablePathIn(dirPath string, index int64) string {
+	return path.Join(dirPath, "lsm_"+strconv.FormatInt(index, 10)+".sstable")
+}
+
+// dataPaths returns the paths new tables go to, fastest first.
+func (lsm *Lsm) dataPaths() []DataPath {
+	if len(lsm.opts.DataPaths) == 0 {
+		return []DataPath{{Path: lsm.rootPath}}
+	}
+	return lsm.opts.DataPaths
+}
+
+// tableDirs returns every directory which may hold tables. The root path
+// comes last, it keeps tables written before DataPaths was set.
+func (lsm *Lsm) tableDirs() []string {
+	dirs := make([]string, 0)
+	rootListed := false
+	for _, p := range lsm.dataPaths() {
+		dirs = append(dirs, p.Path)
+		if filepath.Clean(p.Path) == filepath.Clean(lsm.rootPath) {
+			rootListed = true
+		}
+	}
+	if !rootListed {
+		dirs = append(dirs, lsm.rootPath)
+	}
+	return dirs
+}
+
+func (lsm *Lsm) makeDataPaths() error {
+	for _, p := range lsm.opts.DataPaths {
+		err := lsm.fs.MkdirAll(p.Path, 0700)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (lsm *Lsm) removeDataPaths() {
+	for _, p := range lsm.opts.DataPaths {
+		err := lsm.fs.Remove(p.Path)
+		if err != nil && !os.IsNotExist(err) {
+			lsm.log.Pf(0, "remove %s error %v", p.Path, err)
+		}
+	}
+}
+
+// findSsTables returns the file of every table by id. A crash while a table
+// is moved or merged into another path may leave it in two of them, the
+// copy in the first one is taken and the other is removed unless the Lsm is
+// read only.
+func (lsm *Lsm) findSsTables() (map[int64]string, error) {
+	tables := make(map[int64]string)
+	for _, dir := range lsm.tableDirs() {
+		ids, err := listFileIndexes(lsm.fs, dir, ssTableFileNamePattern)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, id := range ids {
+			filePath := getSsTablePathIn(dir, id)
+			if _, ok := tables[id]; ok {
+				if !lsm.readOnly {
+					lsm.log.Pf(0, "remove duplicate table %s", filePath)
+					lsm.fs.Remove(filePath)
+				}
+				continue
+			}
+			tables[id] = filePath
+		}
+	}
+	return tables, nil
+}
+
+// dataPathFor returns the path for a table of the given id and size. Tables
+// fill the paths newest first, each up to its target size, the last path
+// takes whatever is left. Must be called with ssTableMapLock held.
+func (lsm *Lsm) dataPathFor(id int64, size int64) string {
+	newer := size
+	for otherId, st := range lsm.ssTableMap {
+		if otherId > id {
+			newer += st.size
+		}
+	}
+
+	paths := lsm.dataPaths()
+	limit := int64(0)
+	for i, p := range paths {
+		limit += p.TargetSize
+		if p.TargetSize == 0 || newer <= limit || i == len(paths)-1 {
+			return p.Path
+		}
+	}
+	return lsm.rootPath
+}
+
+// placeSsTables moves the tables which aged out of their path, so the
+// newest data stays on the fastest one. Must be called with ssTableMapLock
+// held for writing.
+func (lsm *Lsm) placeSsTables() error {
+	if len(lsm.opts.DataPaths) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(lsm.ssTableMap))
+	for id := range lsm.ssTableMap {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+
+	for _, id := range ids {
+		st := lsm.ssTableMap[id]
+		dirPath := lsm.dataPathFor(id, st.size)
+		if filepath.Dir(st.filePath) == filepath.Clean(dirPath) {
+			continue
+		}
+
+		err := lsm.moveSsTable(st, getSsTablePathIn(dirPath, id))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveSsTable renames the file of st to dstPath or, across devices, copies
+// it and removes the source once the copy is in place.
+func (lsm *Lsm) moveSsTable(st *SsTable, dstPath string) error {
+	srcPath := st.filePath
+	lsm.log.Pf(0, "move %s -> %s", srcPath, dstPath)
+
+	copied := false
+	err := lsm.fs.Rename(srcPath, dstPath)
+	if err != nil {
+		tmpPath := dstPath + ".tmp"
+		err = copyFile(lsm.fs, srcPath, tmpPath)
+		if err != nil {
+			return lsm.spaceError(err)
+		}
+		err = lsm.fs.Rename(tmpPath, dstPath)
+		if err != nil {
+			lsm.fs.Remove(tmpPath)
+			return err
+		}
+		copied = true
+	}
+
+	err = lsm.fs.SyncDir(filepath.Dir(dstPath))
+	if err != nil {
+		return err
+	}
+
+	err = st.reopen(dstPath)
+	if err != nil {
+		return err
+	}
+
+	if copied {
+		err = lsm.fs.Remove(srcPath)
+		if err != nil {
+			lsm.log.Pf(0, "remove %s error %v", srcPath, err)
+		}
+	}
+	return nil
+}
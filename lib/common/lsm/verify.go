@@ -0,0 +1,336 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	log "github.com/irqlevel/naiv/lib/common/log"
+	"github.com/irqlevel/naiv/lib/common/vfs"
+)
+
+var (
+	ErrLsmNodeBadKeyOrder = fmt.Errorf("Lsm node bad key order")
+)
+
+type CorruptRecord struct {
+	Offset int64
+	Err    error
+}
+
+type VerifyReport struct {
+	FilePath string
+	Records  int64
+	Corrupt  []CorruptRecord
+}
+
+func (r *VerifyReport) Ok() bool {
+	return len(r.Corrupt) == 0
+}
+
+// scanFile reads every record of a table or log file. A record which fails
+// to decode is reported to bad and scanning resumes from the next block
+// which starts with a valid record. The blocks skipped on the way are part
+// of the same report, so one corrupt large value is reported once.
+func scanFile(fs vfs.FS, codec nodeCodec, filePath string, good func(offset int64, node *LsmNode) error,
+	bad func(offset int64, err error)) error {
+	file, err := fs.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	nr, err := openNodeReader(file, filePath, codec)
+	if err != nil {
+		return err
+	}
+
+	skipping := false
+	for {
+		offset := nr.offset
+		node, err := nr.next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			var corruption *CorruptionError
+			if errors.As(err, &corruption) {
+				err = corruption.Err
+			}
+			if !skipping {
+				bad(offset, err)
+				skipping = true
+			}
+
+			nr.offset = offset + IoBlockSize
+			_, err = file.Seek(nr.offset, os.SEEK_SET)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		skipping = false
+
+		err = good(offset, node)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// VerifyFile checks magic and checksum of every record in filePath and, if
+// sorted is set, that keys are increasing as in a table. The retained
+// versions of a key follow each other newest first. The file system and
+// the key provider are taken from opts.
+func VerifyFile(filePath string, sorted bool, opts *LsmOptions) (*VerifyReport, error) {
+	return verifyFile(lsmFS(opts), opts.codec(), filePath, sorted)
+}
+
+func verifyFile(fs vfs.FS, codec nodeCodec, filePath string, sorted bool) (*VerifyReport, error) {
+	r := &VerifyReport{FilePath: filePath, Corrupt: make([]CorruptRecord, 0)}
+	var prevKey *string
+	var prevSeq uint64
+
+	err := scanFile(fs, codec, filePath,
+		func(offset int64, node *LsmNode) error {
+			r.Records++
+			if sorted {
+				if prevKey != nil && (node.key < *prevKey || (node.key == *prevKey && node.seq >= prevSeq)) {
+					r.Corrupt = append(r.Corrupt, CorruptRecord{Offset: offset, Err: ErrLsmNodeBadKeyOrder})
+				}
+				prevKey = &node.key
+				prevSeq = node.seq
+			}
+			return nil
+		},
+		func(offset int64, err error) {
+			r.Corrupt = append(r.Corrupt, CorruptRecord{Offset: offset, Err: err})
+		})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// VerifyLsm checks every table and the log under rootPath.
+func VerifyLsm(rootPath string, opts *LsmOptions) ([]*VerifyReport, error) {
+	return verifyLsm(lsmFS(opts), opts.codec(), rootPath)
+}
+
+func verifyLsm(fs vfs.FS, codec nodeCodec, rootPath string) ([]*VerifyReport, error) {
+	dirs, err := listTableDirs(fs, rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]*VerifyReport, 0)
+	for _, dir := range dirs {
+		dirPath := filepath.Join(rootPath, dir)
+		ids, err := listFileIndexes(fs, dirPath, ssTableFileNamePattern)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range ids {
+			r, err := verifyFile(fs, codec, path.Join(dirPath, "lsm_"+strconv.FormatInt(id, 10)+".sstable"), true)
+			if err != nil {
+				return nil, err
+			}
+			reports = append(reports, r)
+		}
+	}
+
+	r, err := verifyFile(fs, codec, filepath.Join(rootPath, logFileName), false)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return reports, nil
+		}
+		return nil, err
+	}
+	return append(reports, r), nil
+}
+
+// RepairLsm copies every readable record under rootPath into a new Lsm
+// directory at dstPath, keeping table ids. Corrupt records are skipped.
+// The copies are encrypted if opts has a key provider.
+func RepairLsm(log log.LogInterface, rootPath string, dstPath string, opts *LsmOptions) error {
+	log.Pf(0, "repair %s -> %s", rootPath, dstPath)
+
+	fs := lsmFS(opts)
+	codec := opts.codec()
+	_, err := fs.Stat(dstPath)
+	if err == nil {
+		return ErrRestoreTargetExists
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	err = fs.MkdirAll(dstPath, 0700)
+	if err != nil {
+		return err
+	}
+
+	dirs, err := listTableDirs(fs, rootPath)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		err = repairTables(fs, log, codec, filepath.Join(rootPath, dir), filepath.Join(dstPath, dir))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = copyManifest(fs, rootPath, dstPath)
+	if err != nil {
+		return err
+	}
+
+	logFile, err := fs.OpenFile(filepath.Join(dstPath, logFileName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	w := &countingWriter{w: logFile}
+	c, err := writeFileHeader(w, codec.keys)
+	if err != nil {
+		return err
+	}
+
+	salvaged, lost := 0, 0
+	err = scanFile(fs, codec, filepath.Join(rootPath, logFileName),
+		func(offset int64, node *LsmNode) error {
+			salvaged++
+			return node.writeTo(w, c, w.n)
+		},
+		func(offset int64, err error) {
+			lost++
+		})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Pf(0, "repair %s salvaged %d corrupt ranges %d", logFileName, salvaged, lost)
+
+	err = logFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	log.Pf(0, "repair %s -> %s done", rootPath, dstPath)
+	return nil
+}
+
+func repairTables(fs vfs.FS, log log.LogInterface, codec nodeCodec, srcPath string, dstPath string) error {
+	err := fs.MkdirAll(dstPath, 0700)
+	if err != nil {
+		return err
+	}
+
+	ids, err := listFileIndexes(fs, srcPath, ssTableFileNamePattern)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		name := "lsm_" + strconv.FormatInt(id, 10) + ".sstable"
+		versions := make(map[string][]*LsmNode)
+		salvaged, lost := 0, 0
+		err = scanFile(fs, codec, path.Join(srcPath, name),
+			func(offset int64, node *LsmNode) error {
+				versions[node.key] = append(versions[node.key], node)
+				salvaged++
+				return nil
+			},
+			func(offset int64, err error) {
+				lost++
+			})
+		if err != nil {
+			return err
+		}
+
+		log.Pf(0, "repair %s salvaged %d corrupt ranges %d", name, salvaged, lost)
+		if len(versions) == 0 {
+			continue
+		}
+
+		// Every retained version is kept, chained newest first
+		nodeMap := make(map[string]*LsmNode)
+		for key, nodes := range versions {
+			sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].seq > nodes[j].seq })
+			for i := 1; i < len(nodes); i++ {
+				nodes[i-1].older = nodes[i]
+			}
+			nodeMap[key] = nodes[0]
+		}
+
+		st, err := newSsTable(fs, log, path.Join(dstPath, name), nodeMap, nil, codec)
+		if err != nil {
+			return err
+		}
+		st.Close()
+	}
+	return nil
+}
+
+type FileRecord struct {
+	Offset    int64
+	Key       string
+	Value     string
+	Deleted   bool
+	Seq       uint64
+	Timestamp int64
+	// Checksum is the stored checksum of the record, it matched the data
+	Checksum uint64
+	// Indexed is set for records SsTable.index keeps in the sparse index,
+	// never for those of a log
+	Indexed bool
+	// Err is set if the record at Offset failed to decode
+	Err error
+}
+
+// ScanFile calls fn for every record of a table or log file in file order,
+// including records which failed to decode.
+func ScanFile(filePath string, opts *LsmOptions, fn func(r *FileRecord) error) error {
+	name := filepath.Base(filePath)
+	isLog := name == logFileName || archiveFileNamePattern.MatchString(name)
+
+	// Mirrors SsTable.index, an index entry waits for the newest version
+	// of the following key
+	i := int64(0)
+	indexDue := false
+	prevKey := ""
+	var cbErr error
+	err := scanFile(lsmFS(opts), opts.codec(), filePath,
+		func(offset int64, node *LsmNode) error {
+			r := &FileRecord{Offset: offset, Key: node.key, Value: node.value,
+				Deleted: node.deleted, Seq: node.seq, Timestamp: node.timestamp,
+				Checksum: node.checksum}
+			if i%keysPerIndex == 0 {
+				indexDue = true
+			}
+			if !isLog && indexDue && (i == 0 || node.key != prevKey) {
+				r.Indexed = true
+				indexDue = false
+			}
+			prevKey = node.key
+			i++
+			return fn(r)
+		},
+		func(offset int64, err error) {
+			if cbErr == nil {
+				cbErr = fn(&FileRecord{Offset: offset, Err: err})
+			}
+		})
+	if err != nil {
+		return err
+	}
+	return cbErr
+}
@@ -0,0 +1,100 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityHigh
+)
+
+const (
+	maxWaitMs = 10
+)
+
+// RateLimiter is a token bucket of bytes refilled at a given rate per
+// second with a burst of one second. Low priority requests wait while high
+// priority ones are pending. A rate of zero means no limit.
+type RateLimiter struct {
+	lock        sync.Mutex
+	rate        int64
+	tokens      float64
+	last        time.Time
+	waitingHigh int
+}
+
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	r := new(RateLimiter)
+	r.rate = bytesPerSec
+	r.tokens = float64(bytesPerSec)
+	r.last = time.Now()
+	return r
+}
+
+func (r *RateLimiter) refill() {
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * float64(r.rate)
+	if r.tokens > float64(r.rate) {
+		r.tokens = float64(r.rate)
+	}
+	r.last = now
+}
+
+// SetRate changes the rate, waiting requests pick it up at once.
+func (r *RateLimiter) SetRate(bytesPerSec int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.refill()
+	r.rate = bytesPerSec
+	if r.tokens > float64(r.rate) {
+		r.tokens = float64(r.rate)
+	}
+}
+
+func (r *RateLimiter) Rate() int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.rate
+}
+
+// Request blocks until n bytes may be written. Requests larger than the
+// burst are let through once the bucket is not empty and leave it in debt.
+func (r *RateLimiter) Request(n int64, priority Priority) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if priority == PriorityHigh {
+		r.waitingHigh++
+		defer func() { r.waitingHigh-- }()
+	}
+
+	for {
+		if r.rate <= 0 {
+			return
+		}
+
+		r.refill()
+		if r.tokens > 0 && (priority == PriorityHigh || r.waitingHigh == 0) {
+			r.tokens -= float64(n)
+			return
+		}
+
+		wait := time.Millisecond
+		if r.tokens < 0 {
+			wait = time.Duration(-r.tokens / float64(r.rate) * float64(time.Second))
+		}
+		if wait > maxWaitMs*time.Millisecond {
+			wait = maxWaitMs * time.Millisecond
+		}
+
+		r.lock.Unlock()
+		time.Sleep(wait)
+		r.lock.Lock()
+	}
+}
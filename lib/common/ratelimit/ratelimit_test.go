@@ -0,0 +1,35 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRequest(t *testing.T) {
+	r := NewRateLimiter(100000)
+
+	begin := time.Now()
+	r.Request(100000, PriorityLow)
+	if time.Since(begin) > 50*time.Millisecond {
+		t.Fatalf("burst request waited %v", time.Since(begin))
+		return
+	}
+
+	// Bucket is in debt now, the next request waits for it to be repaid
+	begin = time.Now()
+	r.Request(50000, PriorityLow)
+	r.Request(1, PriorityLow)
+	if time.Since(begin) < 400*time.Millisecond {
+		t.Fatalf("request waited only %v", time.Since(begin))
+		return
+	}
+
+	r.SetRate(0)
+	begin = time.Now()
+	r.Request(1000000000, PriorityHigh)
+	r.Request(1000000000, PriorityLow)
+	if time.Since(begin) > 50*time.Millisecond {
+		t.Fatalf("unlimited request waited %v", time.Since(begin))
+		return
+	}
+}
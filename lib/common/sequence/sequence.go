@@ -14,6 +14,11 @@ type Sequence struct {
 	lock   sync.RWMutex
 	data   []float64
 	sorted bool
+	// limit bounds a sequence to its newest samples, data then keeps
+	// append order with the oldest at next and is sorted into sortedData
+	limit      int
+	next       int
+	sortedData []float64
 }
 
 func NewSequence() *Sequence {
@@ -22,11 +27,25 @@ func NewSequence() *Sequence {
 	return s
 }
 
+// NewBoundedSequence returns a sequence which keeps the newest limit
+// samples only.
+func NewBoundedSequence(limit int) *Sequence {
+	s := new(Sequence)
+	s.data = make([]float64, 0, limit)
+	s.limit = limit
+	return s
+}
+
 func (s *Sequence) Append(v float64) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	s.data = append(s.data, v)
+	if s.limit != 0 && len(s.data) == s.limit {
+		s.data[s.next] = v
+		s.next = (s.next + 1) % s.limit
+	} else {
+		s.data = append(s.data, v)
+	}
 	s.sorted = false
 }
 
@@ -46,11 +65,18 @@ func (s *Sequence) GetAverage() float64 {
 	return sum / float64(len(s.data))
 }
 
-func (s *Sequence) sort() {
+// sort returns the samples in increasing order
+func (s *Sequence) sort() []float64 {
 	if !s.sorted {
-		sort.Slice(s.data, func(i, j int) bool { return s.data[i] < s.data[j] })
+		if s.limit != 0 {
+			s.sortedData = append(s.sortedData[:0], s.data...)
+		} else {
+			s.sortedData = s.data
+		}
+		sort.Slice(s.sortedData, func(i, j int) bool { return s.sortedData[i] < s.sortedData[j] })
 		s.sorted = true
 	}
+	return s.sortedData
 }
 
 func (s *Sequence) Get50P() float64 {
@@ -61,8 +87,8 @@ func (s *Sequence) Get50P() float64 {
 		return 0
 	}
 
-	s.sort()
-	return s.data[(50*len(s.data))/100]
+	data := s.sort()
+	return data[(50*len(data))/100]
 }
 
 func (s *Sequence) Get99P() float64 {
@@ -73,8 +99,8 @@ func (s *Sequence) Get99P() float64 {
 		return 0
 	}
 
-	s.sort()
-	return s.data[(99*len(s.data))/100]
+	data := s.sort()
+	return data[(99*len(data))/100]
 }
 
 func (s *Sequence) Get95P() float64 {
@@ -85,8 +111,8 @@ func (s *Sequence) Get95P() float64 {
 		return 0
 	}
 
-	s.sort()
-	return s.data[(95*len(s.data))/100]
+	data := s.sort()
+	return data[(95*len(data))/100]
 }
 
 func (s *Sequence) Count() int {
@@ -0,0 +1,447 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FaultFS wraps a file system to inject failures. Writes and syncs can be
+// made to fail, Crash drops everything written since the last sync and
+// undoes creates and renames whose directory wasn't synced, FlipBit
+// corrupts stored data. Durability is tracked per path for append only files, which is how
+// the storage engine writes.
+type FaultFS struct {
+	base FS
+
+	lock        sync.Mutex
+	writeErr    error
+	writesLeft  int
+	syncErr     error
+	removeErr   error
+	removesLeft int
+	synced      map[string]int64
+	tear        int64
+	// renames are those not made durable by SyncDir yet, oldest first
+	renames []faultRename
+	// created are the files whose directory wasn't synced since they were
+	// created
+	created map[string]bool
+}
+
+type faultRename struct {
+	oldName string
+	newName string
+	// replaced is the synced data of the file newName replaced, nil if
+	// there was none
+	replaced []byte
+	// created is set if oldName was created and not made durable
+	created bool
+}
+
+func NewFaultFS(base FS) *FaultFS {
+	fs := new(FaultFS)
+	fs.base = base
+	fs.synced = make(map[string]int64)
+	fs.created = make(map[string]bool)
+	return fs
+}
+
+// FailWrites makes every write after the next n ones fail with err, a nil
+// err stops failing writes.
+func (fs *FaultFS) FailWrites(n int, err error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.writeErr = err
+	fs.writesLeft = n
+}
+
+// FailSyncs makes every sync fail with err, a nil err stops failing syncs.
+func (fs *FaultFS) FailSyncs(err error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.syncErr = err
+}
+
+// FailRemoves makes every remove after the next n ones fail with err, a nil
+// err stops failing removes.
+func (fs *FaultFS) FailRemoves(n int, err error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.removeErr = err
+	fs.removesLeft = n
+}
+
+// TearOnCrash makes Crash keep up to n bytes written to a file after its
+// last sync, so the last record may be cut in the middle.
+func (fs *FaultFS) TearOnCrash(n int64) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.tear = n
+}
+
+// Crash undoes the renames which weren't made durable, removes the files
+// created since the last sync of their directory and cuts every other file
+// back to the size it had at its last sync, plus what TearOnCrash keeps.
+func (fs *FaultFS) Crash() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	for i := len(fs.renames) - 1; i >= 0; i-- {
+		err := fs.undoRename(fs.renames[i])
+		if err != nil {
+			return err
+		}
+	}
+	fs.renames = nil
+
+	for name := range fs.created {
+		err := fs.base.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(fs.synced, name)
+	}
+	fs.created = make(map[string]bool)
+
+	// What is left is durable, files still open carry on from it
+	for name, size := range fs.synced {
+		info, err := fs.base.Stat(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				delete(fs.synced, name)
+				continue
+			}
+			return err
+		}
+		if info.Size()-size <= fs.tear {
+			fs.synced[name] = info.Size()
+			continue
+		}
+		size += fs.tear
+		fs.synced[name] = size
+
+		f, err := fs.base.OpenFile(name, os.O_RDWR, 0600)
+		if err != nil {
+			return err
+		}
+		err = f.Truncate(size)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// undoRename moves newName back and restores the file it replaced. Must be
+// called with fs.lock held.
+func (fs *FaultFS) undoRename(r faultRename) error {
+	err := fs.base.Rename(r.newName, r.oldName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	size, ok := fs.synced[r.newName]
+	delete(fs.synced, r.newName)
+	if ok {
+		fs.synced[r.oldName] = size
+	}
+	if r.created {
+		fs.created[r.oldName] = true
+	}
+
+	if r.replaced == nil {
+		return nil
+	}
+	f, err := fs.base.OpenFile(r.newName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(r.replaced)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	fs.synced[r.newName] = int64(len(r.replaced))
+	return nil
+}
+
+// syncedData reads what of name survives a crash, nil if there is no such
+// file. Must be called with fs.lock held.
+func (fs *FaultFS) syncedData(name string) ([]byte, error) {
+	f, err := fs.base.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if synced, ok := fs.synced[name]; ok && synced < size {
+		size = synced
+	}
+
+	data := make([]byte, size)
+	_, err = f.ReadAt(data, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// FlipBit inverts one bit of the byte at offset in name.
+func (fs *FaultFS) FlipBit(name string, offset int64, bit uint) error {
+	f, err := fs.base.OpenFile(name, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, offset)
+	if err != nil {
+		return err
+	}
+	b[0] ^= 1 << (bit % 8)
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	return err
+}
+
+func (fs *FaultFS) track(name string, size int64, created bool) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	_, ok := fs.synced[name]
+	if !ok {
+		fs.synced[name] = size
+	}
+	if created {
+		fs.created[name] = true
+	}
+}
+
+func (fs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	_, statErr := fs.base.Stat(name)
+
+	f, err := fs.base.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, nil
+	}
+
+	// Data which was there before is considered durable, a new file is not
+	size := int64(0)
+	if statErr == nil && flag&os.O_TRUNC == 0 {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		size = info.Size()
+	}
+	fs.track(name, size, os.IsNotExist(statErr))
+	return &faultFile{File: f, fs: fs, name: name}, nil
+}
+
+func (fs *FaultFS) Open(name string) (File, error) {
+	return fs.base.Open(name)
+}
+
+func (fs *FaultFS) Remove(name string) error {
+	fs.lock.Lock()
+	err := fs.removeErr
+	if err != nil && fs.removesLeft > 0 {
+		fs.removesLeft--
+		err = nil
+	}
+	fs.lock.Unlock()
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	err = fs.base.Remove(name)
+	if err == nil {
+		fs.lock.Lock()
+		delete(fs.synced, filepath.Clean(name))
+		delete(fs.created, filepath.Clean(name))
+		fs.lock.Unlock()
+	}
+	return err
+}
+
+func (fs *FaultFS) Rename(oldName string, newName string) error {
+	oldName = filepath.Clean(oldName)
+	newName = filepath.Clean(newName)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	replaced, err := fs.syncedData(newName)
+	if err != nil {
+		return err
+	}
+
+	err = fs.base.Rename(oldName, newName)
+	if err != nil {
+		return err
+	}
+
+	size, ok := fs.synced[oldName]
+	delete(fs.synced, oldName)
+	if ok {
+		fs.synced[newName] = size
+	} else {
+		delete(fs.synced, newName)
+	}
+	created := fs.created[oldName]
+	delete(fs.created, oldName)
+	delete(fs.created, newName)
+	fs.renames = append(fs.renames, faultRename{oldName: oldName, newName: newName,
+		replaced: replaced, created: created})
+	return nil
+}
+
+// SyncDir makes the creates and renames into path durable.
+func (fs *FaultFS) SyncDir(path string) error {
+	err := fs.base.SyncDir(path)
+	if err != nil {
+		return err
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	path = filepath.Clean(path)
+	renames := fs.renames[:0]
+	for _, r := range fs.renames {
+		if filepath.Dir(r.newName) != path {
+			renames = append(renames, r)
+		}
+	}
+	fs.renames = renames
+
+	for name := range fs.created {
+		if filepath.Dir(name) == path {
+			delete(fs.created, name)
+		}
+	}
+	return nil
+}
+
+func (fs *FaultFS) Link(oldName string, newName string) error {
+	err := fs.base.Link(oldName, newName)
+	if err == nil {
+		fs.lock.Lock()
+		size, ok := fs.synced[filepath.Clean(oldName)]
+		if ok {
+			fs.synced[filepath.Clean(newName)] = size
+		}
+		fs.created[filepath.Clean(newName)] = true
+		fs.lock.Unlock()
+	}
+	return err
+}
+
+func (fs *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	return fs.base.MkdirAll(path, perm)
+}
+
+func (fs *FaultFS) Stat(name string) (os.FileInfo, error) {
+	return fs.base.Stat(name)
+}
+
+func (fs *FaultFS) ReadDir(dirName string) ([]os.FileInfo, error) {
+	return fs.base.ReadDir(dirName)
+}
+
+func (fs *FaultFS) SameFile(fi1 os.FileInfo, fi2 os.FileInfo) bool {
+	return fs.base.SameFile(fi1, fi2)
+}
+
+func (fs *FaultFS) FreeSpace(path string) (int64, error) {
+	return fs.base.FreeSpace(path)
+}
+
+func (fs *FaultFS) Lock(name string, exclusive bool) (io.Closer, error) {
+	return fs.base.Lock(name, exclusive)
+}
+
+type faultFile struct {
+	File
+	fs   *FaultFS
+	name string
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.fs.lock.Lock()
+	if f.fs.writeErr != nil {
+		if f.fs.writesLeft <= 0 {
+			err := f.fs.writeErr
+			f.fs.lock.Unlock()
+			return 0, err
+		}
+		f.fs.writesLeft--
+	}
+	f.fs.lock.Unlock()
+
+	return f.File.Write(p)
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.lock.Lock()
+	err := f.fs.syncErr
+	f.fs.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = f.File.Sync()
+	if err != nil {
+		return err
+	}
+
+	info, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+
+	f.fs.lock.Lock()
+	f.fs.synced[f.name] = info.Size()
+	f.fs.lock.Unlock()
+	return nil
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	err := f.File.Truncate(size)
+	if err != nil {
+		return err
+	}
+
+	f.fs.lock.Lock()
+	synced, ok := f.fs.synced[f.name]
+	if ok && synced > size {
+		f.fs.synced[f.name] = size
+	}
+	f.fs.lock.Unlock()
+	return nil
+}
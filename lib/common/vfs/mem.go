@@ -0,0 +1,581 @@
+package vfs
+
+import (
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type memInode struct {
+	lock    sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+	inode   *memInode
+}
+
+func (fi *memFileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *memFileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0700
+	}
+	return 0600
+}
+
+func (fi *memFileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *memFileInfo) IsDir() bool {
+	return fi.dir
+}
+
+func (fi *memFileInfo) Sys() interface{} {
+	return fi.inode
+}
+
+func newMemFileInfo(name string, inode *memInode) *memFileInfo {
+	inode.lock.RLock()
+	defer inode.lock.RUnlock()
+
+	return &memFileInfo{name: filepath.Base(name), size: int64(len(inode.data)),
+		modTime: inode.modTime, inode: inode}
+}
+
+type memLock struct {
+	exclusive bool
+	shared    int
+}
+
+// MemFS keeps files in memory, it is meant for tests.
+type MemFS struct {
+	lock     sync.Mutex
+	files    map[string]*memInode
+	dirs     map[string]bool
+	locks    map[string]*memLock
+	capacity int64
+}
+
+func NewMemFS() *MemFS {
+	fs := new(MemFS)
+	fs.files = make(map[string]*memInode)
+	fs.dirs = make(map[string]bool)
+	fs.locks = make(map[string]*memLock)
+	fs.dirs["/"] = true
+	fs.dirs["."] = true
+	return fs
+}
+
+func notExist(op string, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func exist(op string, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+}
+
+type memFile struct {
+	fs     *MemFS
+	name   string
+	inode  *memInode
+	lock   sync.Mutex
+	offset int64
+	flag   int
+	closed bool
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.dirs[name] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrInvalid}
+	}
+
+	inode, ok := fs.files[name]
+	if ok {
+		if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			return nil, exist("open", name)
+		}
+	} else {
+		if flag&os.O_CREATE == 0 {
+			return nil, notExist("open", name)
+		}
+		if !fs.dirs[filepath.Dir(name)] {
+			return nil, notExist("open", name)
+		}
+		inode = &memInode{data: make([]byte, 0), modTime: time.Now()}
+		fs.files[name] = inode
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		inode.lock.Lock()
+		inode.data = inode.data[:0]
+		inode.modTime = time.Now()
+		inode.lock.Unlock()
+	}
+
+	return &memFile{fs: fs, name: name, inode: inode, flag: flag}, nil
+}
+
+func (fs *MemFS) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	_, ok := fs.files[name]
+	if ok {
+		delete(fs.files, name)
+		return nil
+	}
+
+	if fs.dirs[name] {
+		prefix := name + string(filepath.Separator)
+		for other := range fs.files {
+			if strings.HasPrefix(other, prefix) {
+				return &os.PathError{Op: "remove", Path: name, Err: os.ErrExist}
+			}
+		}
+		for other := range fs.dirs {
+			if strings.HasPrefix(other, prefix) {
+				return &os.PathError{Op: "remove", Path: name, Err: os.ErrExist}
+			}
+		}
+		delete(fs.dirs, name)
+		return nil
+	}
+	return notExist("remove", name)
+}
+
+func (fs *MemFS) Rename(oldName string, newName string) error {
+	oldName = filepath.Clean(oldName)
+	newName = filepath.Clean(newName)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	inode, ok := fs.files[oldName]
+	if !ok {
+		return notExist("rename", oldName)
+	}
+	if !fs.dirs[filepath.Dir(newName)] {
+		return notExist("rename", newName)
+	}
+
+	delete(fs.files, oldName)
+	fs.files[newName] = inode
+	return nil
+}
+
+func (fs *MemFS) Link(oldName string, newName string) error {
+	oldName = filepath.Clean(oldName)
+	newName = filepath.Clean(newName)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	inode, ok := fs.files[oldName]
+	if !ok {
+		return notExist("link", oldName)
+	}
+	_, ok = fs.files[newName]
+	if ok {
+		return exist("link", newName)
+	}
+	if !fs.dirs[filepath.Dir(newName)] {
+		return notExist("link", newName)
+	}
+
+	fs.files[newName] = inode
+	return nil
+}
+
+func (fs *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	path = filepath.Clean(path)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	for {
+		_, ok := fs.files[path]
+		if ok {
+			return exist("mkdir", path)
+		}
+		fs.dirs[path] = true
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return nil
+		}
+		path = parent
+	}
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.dirs[name] {
+		return &memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+
+	inode, ok := fs.files[name]
+	if !ok {
+		return nil, notExist("stat", name)
+	}
+	return newMemFileInfo(name, inode), nil
+}
+
+func (fs *MemFS) ReadDir(dirName string) ([]os.FileInfo, error) {
+	dirName = filepath.Clean(dirName)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if !fs.dirs[dirName] {
+		return nil, notExist("readdir", dirName)
+	}
+
+	infos := make([]os.FileInfo, 0)
+	for name, inode := range fs.files {
+		if filepath.Dir(name) == dirName {
+			infos = append(infos, newMemFileInfo(name, inode))
+		}
+	}
+	for name := range fs.dirs {
+		if name != dirName && filepath.Dir(name) == dirName {
+			infos = append(infos, &memFileInfo{name: filepath.Base(name), dir: true})
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (fs *MemFS) SameFile(fi1 os.FileInfo, fi2 os.FileInfo) bool {
+	mfi1, ok1 := fi1.(*memFileInfo)
+	mfi2, ok2 := fi2.(*memFileInfo)
+	return ok1 && ok2 && mfi1.inode != nil && mfi1.inode == mfi2.inode
+}
+
+// SyncDir does nothing, the names of a MemFS don't outlive it.
+func (fs *MemFS) SyncDir(path string) error {
+	path = filepath.Clean(path)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if !fs.dirs[path] {
+		return notExist("sync", path)
+	}
+	return nil
+}
+
+// SetCapacity makes writes fail with ENOSPC once the files would take more
+// than capacity bytes, zero means no limit.
+func (fs *MemFS) SetCapacity(capacity int64) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.capacity = capacity
+}
+
+// used sums the size of the files, must be called with fs.lock held.
+func (fs *MemFS) used() int64 {
+	inodes := make(map[*memInode]bool)
+	size := int64(0)
+	for _, inode := range fs.files {
+		if inodes[inode] {
+			continue
+		}
+		inodes[inode] = true
+
+		inode.lock.RLock()
+		size += int64(len(inode.data))
+		inode.lock.RUnlock()
+	}
+	return size
+}
+
+func (fs *MemFS) FreeSpace(path string) (int64, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.capacity == 0 {
+		return math.MaxInt64, nil
+	}
+	free := fs.capacity - fs.used()
+	if free < 0 {
+		free = 0
+	}
+	return free, nil
+}
+
+// reserve checks that the file of f may grow to end bytes.
+func (fs *MemFS) reserve(f *memFile, end int64) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.capacity == 0 {
+		return nil
+	}
+
+	f.inode.lock.RLock()
+	grow := end - int64(len(f.inode.data))
+	f.inode.lock.RUnlock()
+
+	if grow > 0 && fs.used()+grow > fs.capacity {
+		return &os.PathError{Op: "write", Path: f.name, Err: syscall.ENOSPC}
+	}
+	return nil
+}
+
+type memLockHandle struct {
+	fs        *MemFS
+	name      string
+	exclusive bool
+	closed    bool
+}
+
+func (h *memLockHandle) Close() error {
+	h.fs.lock.Lock()
+	defer h.fs.lock.Unlock()
+
+	if h.closed {
+		return os.ErrClosed
+	}
+	h.closed = true
+
+	l := h.fs.locks[h.name]
+	if h.exclusive {
+		l.exclusive = false
+	} else {
+		l.shared--
+	}
+	return nil
+}
+
+func (fs *MemFS) Lock(name string, exclusive bool) (io.Closer, error) {
+	name = filepath.Clean(name)
+	flag := os.O_RDONLY
+	if exclusive {
+		flag = os.O_RDWR | os.O_CREATE
+	}
+
+	file, err := fs.OpenFile(name, flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	l, ok := fs.locks[name]
+	if !ok {
+		l = new(memLock)
+		fs.locks[name] = l
+	}
+
+	if l.exclusive || (exclusive && l.shared != 0) {
+		return nil, ErrLocked
+	}
+
+	if exclusive {
+		l.exclusive = true
+	} else {
+		l.shared++
+	}
+	return &memLockHandle{fs: fs, name: name, exclusive: exclusive}, nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == os.O_WRONLY {
+		return 0, os.ErrPermission
+	}
+
+	f.inode.lock.RLock()
+	defer f.inode.lock.RUnlock()
+
+	if off >= int64(len(f.inode.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.inode.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.readAt(p, off)
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, os.ErrPermission
+	}
+
+	end := f.offset + int64(len(p))
+	if f.flag&os.O_APPEND != 0 {
+		f.inode.lock.RLock()
+		end = int64(len(f.inode.data)) + int64(len(p))
+		f.inode.lock.RUnlock()
+	}
+	err := f.fs.reserve(f, end)
+	if err != nil {
+		return 0, err
+	}
+
+	f.inode.lock.Lock()
+	defer f.inode.lock.Unlock()
+
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.inode.data))
+	}
+
+	// Growing by append keeps writes at the end linear in their size
+	data := f.inode.data
+	if f.offset > int64(len(data)) {
+		data = append(data, make([]byte, f.offset-int64(len(data)))...)
+	}
+	n := copy(data[f.offset:], p)
+	f.inode.data = append(data, p[n:]...)
+	f.offset += int64(len(p))
+	f.inode.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.inode.lock.RLock()
+		offset += int64(len(f.inode.data))
+		f.inode.lock.RUnlock()
+	default:
+		return 0, os.ErrInvalid
+	}
+
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return os.ErrPermission
+	}
+
+	f.inode.lock.Lock()
+	defer f.inode.lock.Unlock()
+
+	if size < int64(len(f.inode.data)) {
+		f.inode.data = f.inode.data[:size]
+	} else {
+		f.inode.data = append(f.inode.data, make([]byte, size-int64(len(f.inode.data)))...)
+	}
+	f.inode.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	return newMemFileInfo(f.name, f.inode), nil
+}
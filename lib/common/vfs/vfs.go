@@ -0,0 +1,149 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+var (
+	ErrLocked = fmt.Errorf("File is locked")
+)
+
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+}
+
+// FS is the set of file operations the storage engine uses.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Open(name string) (File, error)
+	Remove(name string) error
+	Rename(oldName string, newName string) error
+	Link(oldName string, newName string) error
+	MkdirAll(path string, perm os.FileMode) error
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(dirName string) ([]os.FileInfo, error)
+	SameFile(fi1 os.FileInfo, fi2 os.FileInfo) bool
+	// SyncDir makes the renames of entries into the directory path
+	// durable.
+	SyncDir(path string) error
+	// FreeSpace returns the bytes left for the caller on the file system
+	// holding path.
+	FreeSpace(path string) (int64, error)
+
+	// Lock takes an exclusive or shared lock on name, creating the file if
+	// needed when exclusive. It fails with ErrLocked at once if the lock is
+	// held by someone else. Closing the result releases the lock.
+	Lock(name string, exclusive bool) (io.Closer, error)
+}
+
+type osFS struct{}
+
+// Default is the operating system file system
+var Default FS = osFS{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (osFS) Open(name string) (File, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldName string, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (osFS) Link(oldName string, newName string) error {
+	return os.Link(oldName, newName)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) ReadDir(dirName string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirName)
+}
+
+func (osFS) SameFile(fi1 os.FileInfo, fi2 os.FileInfo) bool {
+	return os.SameFile(fi1, fi2)
+}
+
+func (osFS) SyncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (osFS) FreeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+type osLock struct {
+	file *os.File
+}
+
+func (l *osLock) Close() error {
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	return l.file.Close()
+}
+
+func (osFS) Lock(name string, exclusive bool) (io.Closer, error) {
+	flag := os.O_RDONLY
+	how := syscall.LOCK_SH
+	if exclusive {
+		flag = os.O_RDWR | os.O_CREATE
+		how = syscall.LOCK_EX
+	}
+
+	file, err := os.OpenFile(name, flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return &osLock{file: file}, nil
+}
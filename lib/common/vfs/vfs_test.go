@@ -0,0 +1,331 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+
+	err := fs.MkdirAll("/a/b", 0700)
+	if err != nil {
+		t.Fatalf("can't make dir error %v", err)
+		return
+	}
+
+	f, err := fs.OpenFile("/a/b/f", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		t.Fatalf("can't create file error %v", err)
+		return
+	}
+	_, err = f.Write([]byte("hello"))
+	if err != nil {
+		t.Fatalf("can't write error %v", err)
+		return
+	}
+	f.Close()
+
+	_, err = fs.OpenFile("/a/b/f", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if !os.IsExist(err) {
+		t.Fatalf("exclusive create of existing file error %v", err)
+		return
+	}
+
+	err = fs.Rename("/a/b/f", "/a/g")
+	if err != nil {
+		t.Fatalf("can't rename error %v", err)
+		return
+	}
+
+	f, err = fs.Open("/a/g")
+	if err != nil {
+		t.Fatalf("can't open error %v", err)
+		return
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("read %q error %v", data, err)
+		return
+	}
+
+	infos, err := fs.ReadDir("/a")
+	if err != nil || len(infos) != 2 || infos[0].Name() != "b" || infos[1].Name() != "g" {
+		t.Fatalf("unexpected dir content %v error %v", infos, err)
+		return
+	}
+
+	lock, err := fs.Lock("/a/LOCK", true)
+	if err != nil {
+		t.Fatalf("can't lock error %v", err)
+		return
+	}
+	_, err = fs.Lock("/a/LOCK", false)
+	if err != ErrLocked {
+		t.Fatalf("shared lock of locked file error %v", err)
+		return
+	}
+	lock.Close()
+
+	lock, err = fs.Lock("/a/LOCK", false)
+	if err != nil {
+		t.Fatalf("can't lock shared error %v", err)
+		return
+	}
+	lock.Close()
+}
+
+func TestFaultFS(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+
+	f, err := fs.OpenFile("/f", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("can't create file error %v", err)
+		return
+	}
+	defer f.Close()
+
+	_, err = f.Write([]byte("synced"))
+	if err != nil {
+		t.Fatalf("can't write error %v", err)
+		return
+	}
+	err = f.Sync()
+	if err == nil {
+		err = fs.SyncDir("/")
+	}
+	if err != nil {
+		t.Fatalf("can't sync error %v", err)
+		return
+	}
+	_, err = f.Write([]byte("lost"))
+	if err != nil {
+		t.Fatalf("can't write error %v", err)
+		return
+	}
+
+	errFull := errors.New("no space")
+	fs.FailWrites(0, errFull)
+	_, err = f.Write([]byte("x"))
+	if err != errFull {
+		t.Fatalf("injected write error %v", err)
+		return
+	}
+	fs.FailWrites(0, nil)
+
+	err = fs.Crash()
+	if err != nil {
+		t.Fatalf("can't crash error %v", err)
+		return
+	}
+
+	info, err := fs.Stat("/f")
+	if err != nil || info.Size() != int64(len("synced")) {
+		t.Fatalf("size after crash %v error %v", info, err)
+		return
+	}
+
+	err = fs.FlipBit("/f", 0, 0)
+	if err != nil {
+		t.Fatalf("can't flip bit error %v", err)
+		return
+	}
+
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, 0)
+	if err != nil || b[0] != 's'^1 {
+		t.Fatalf("read %q error %v", b, err)
+		return
+	}
+}
+
+func TestMemFSCapacity(t *testing.T) {
+	fs := NewMemFS()
+	fs.SetCapacity(10)
+
+	f, err := fs.OpenFile("/f", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("can't create file error %v", err)
+		return
+	}
+	defer f.Close()
+
+	_, err = f.Write([]byte("12345678"))
+	if err != nil {
+		t.Fatalf("can't write error %v", err)
+		return
+	}
+
+	free, err := fs.FreeSpace("/")
+	if err != nil || free != 2 {
+		t.Fatalf("free space %d error %v", free, err)
+		return
+	}
+
+	_, err = f.Write([]byte("abc"))
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("write over capacity error %v", err)
+		return
+	}
+
+	err = f.Truncate(4)
+	if err == nil {
+		_, err = f.Write([]byte("abc"))
+	}
+	if err != nil {
+		t.Fatalf("can't write after truncate error %v", err)
+		return
+	}
+}
+
+func writeSynced(fs FS, name string, data string) error {
+	f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write([]byte(data))
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func readAll(fs FS, name string) (string, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	return string(data), err
+}
+
+func TestFaultFSCrashTornAndRenames(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+
+	f, err := fs.OpenFile("/f", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("can't create file error %v", err)
+		return
+	}
+	defer f.Close()
+
+	_, err = f.Write([]byte("synced"))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		_, err = f.Write([]byte("torn record"))
+	}
+	if err != nil {
+		t.Fatalf("can't write error %v", err)
+		return
+	}
+
+	err = writeSynced(fs, "/a", "old")
+	if err == nil {
+		err = writeSynced(fs, "/a.tmp", "new")
+	}
+	if err == nil {
+		err = fs.SyncDir("/")
+	}
+	if err == nil {
+		err = fs.Rename("/a.tmp", "/a")
+	}
+	if err != nil {
+		t.Fatalf("can't replace file error %v", err)
+		return
+	}
+
+	// Created files are lost until their directory is synced, even if
+	// their data was
+	err = writeSynced(fs, "/new", "data")
+	if err == nil {
+		err = writeSynced(fs, "/new.tmp", "data")
+	}
+	if err == nil {
+		err = fs.Rename("/new.tmp", "/renamed")
+	}
+	if err != nil {
+		t.Fatalf("can't create file error %v", err)
+		return
+	}
+
+	fs.TearOnCrash(4)
+	err = fs.Crash()
+	if err != nil {
+		t.Fatalf("can't crash error %v", err)
+		return
+	}
+
+	data, err := readAll(fs, "/f")
+	if err != nil || data != "syncedtorn" {
+		t.Fatalf("torn file %q error %v", data, err)
+		return
+	}
+	for _, name := range []string{"/new", "/new.tmp", "/renamed"} {
+		_, err = fs.Stat(name)
+		if !os.IsNotExist(err) {
+			t.Fatalf("stat created file %s error %v", name, err)
+			return
+		}
+	}
+
+	// The rename was lost, the file it replaced is back
+	data, err = readAll(fs, "/a")
+	if err != nil || data != "old" {
+		t.Fatalf("replaced file %q error %v", data, err)
+		return
+	}
+	data, err = readAll(fs, "/a.tmp")
+	if err != nil || data != "new" {
+		t.Fatalf("renamed file %q error %v", data, err)
+		return
+	}
+
+	err = fs.Rename("/a.tmp", "/a")
+	if err == nil {
+		err = fs.SyncDir("/")
+	}
+	if err == nil {
+		err = fs.Crash()
+	}
+	if err != nil {
+		t.Fatalf("can't rename and crash error %v", err)
+		return
+	}
+
+	data, err = readAll(fs, "/a")
+	if err != nil || data != "new" {
+		t.Fatalf("synced rename %q error %v", data, err)
+		return
+	}
+	_, err = fs.Stat("/a.tmp")
+	if !os.IsNotExist(err) {
+		t.Fatalf("stat renamed file error %v", err)
+		return
+	}
+
+	// Writes inside and past the end of a file
+	_, err = f.Seek(4, io.SeekStart)
+	if err == nil {
+		_, err = f.Write([]byte("ED and more"))
+	}
+	if err != nil {
+		t.Fatalf("can't overwrite error %v", err)
+		return
+	}
+	data, err = readAll(fs, "/f")
+	if err != nil || data != "syncED and more" {
+		t.Fatalf("overwritten file %q error %v", data, err)
+		return
+	}
+}
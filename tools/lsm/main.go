@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/irqlevel/naiv/lib/common/filelog"
+	"github.com/irqlevel/naiv/lib/common/log"
+	"github.com/irqlevel/naiv/lib/common/lsm"
+)
+
+// out is where commands print their results
+var out io.Writer = os.Stdout
+
+type command struct {
+	name  string
+	usage string
+	run   func(log log.LogInterface, args []string) error
+}
+
+var commands = []command{
+	{"verify", "verify -dir DIR [-keys DIR]", verify},
+	{"repair", "repair -dir DIR -target DIR [-keys DIR]", repair},
+	{"sstdump", "sstdump -file FILE [-start KEY] [-end KEY] [-hex] [-json] [-summary] [-keys DIR]", sstdump},
+	{"restore", "restore -backup DIR -archive DIR -target DIR [-until-seq N] [-until-time RFC3339] [-keys DIR]", restore},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: naiv-lsm <command> [arguments]\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "    %s\n", cmd.usage)
+	}
+	os.Exit(2)
+}
+
+// keysFlag adds the flag naming the master key directory of encrypted files
+// and returns the options to open them with.
+func keysFlag(fs *flag.FlagSet) func() *lsm.LsmOptions {
+	keyPath := fs.String("keys", "", "master key directory of encrypted files")
+	return func() *lsm.LsmOptions {
+		opts := lsm.DefaultLsmOptions()
+		if *keyPath != "" {
+			opts.KeyProvider = lsm.NewFileKeyProvider(*keyPath)
+		}
+		return opts
+	}
+}
+
+func verify(log log.LogInterface, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	rootPath := fs.String("dir", "", "lsm directory")
+	opts := keysFlag(fs)
+	fs.Parse(args)
+
+	if *rootPath == "" {
+		fs.Usage()
+		return fmt.Errorf("dir is required")
+	}
+
+	reports, err := lsm.VerifyLsm(*rootPath, opts())
+	if err != nil {
+		return err
+	}
+
+	bad := 0
+	for _, r := range reports {
+		fmt.Fprintf(out, "%s records %d corrupt %d\n", r.FilePath, r.Records, len(r.Corrupt))
+		for _, c := range r.Corrupt {
+			fmt.Fprintf(out, "    offset %d: %v\n", c.Offset, c.Err)
+		}
+		if !r.Ok() {
+			bad++
+		}
+	}
+
+	if bad != 0 {
+		return fmt.Errorf("%d of %d files are corrupt", bad, len(reports))
+	}
+	return nil
+}
+
+func repair(log log.LogInterface, args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	rootPath := fs.String("dir", "", "lsm directory")
+	targetPath := fs.String("target", "", "directory to write salvaged data into, must not exist")
+	opts := keysFlag(fs)
+	fs.Parse(args)
+
+	if *rootPath == "" || *targetPath == "" {
+		fs.Usage()
+		return fmt.Errorf("dir and target are required")
+	}
+
+	return lsm.RepairLsm(log, *rootPath, *targetPath, opts())
+}
+
+type dumpRecord struct {
+	Offset    int64  `json:"offset"`
+	Key       string `json:"key,omitempty"`
+	Value     string `json:"value,omitempty"`
+	Deleted   bool   `json:"deleted"`
+	Seq       uint64 `json:"seq"`
+	Timestamp int64  `json:"timestamp"`
+	Checksum  string `json:"checksum,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type dumpIndexEntry struct {
+	Key    string `json:"key"`
+	Offset int64  `json:"offset"`
+}
+
+type dumpSummary struct {
+	FilePath       string           `json:"file"`
+	MinKey         string           `json:"min_key"`
+	MaxKey         string           `json:"max_key"`
+	Records        int64            `json:"records"`
+	Tombstones     int64            `json:"tombstones"`
+	TombstoneRatio float64          `json:"tombstone_ratio"`
+	Corrupt        int64            `json:"corrupt"`
+	Index          []dumpIndexEntry `json:"index"`
+}
+
+type dump struct {
+	Records []dumpRecord `json:"records,omitempty"`
+	Summary dumpSummary  `json:"summary"`
+}
+
+func sstdump(log log.LogInterface, args []string) error {
+	fs := flag.NewFlagSet("sstdump", flag.ExitOnError)
+	filePath := fs.String("file", "", "table or log file")
+	start := fs.String("start", "", "first key to dump, inclusive")
+	end := fs.String("end", "", "last key to dump, exclusive")
+	asHex := fs.Bool("hex", false, "print keys and values as hex")
+	asJson := fs.Bool("json", false, "print as json")
+	summaryOnly := fs.Bool("summary", false, "print only the summary")
+	opts := keysFlag(fs)
+	fs.Parse(args)
+
+	if *filePath == "" {
+		fs.Usage()
+		return fmt.Errorf("file is required")
+	}
+
+	format := func(s string) string {
+		if *asHex {
+			return hex.EncodeToString([]byte(s))
+		}
+		return s
+	}
+
+	d := &dump{Records: make([]dumpRecord, 0)}
+	d.Summary.FilePath = *filePath
+	d.Summary.Index = make([]dumpIndexEntry, 0)
+
+	err := lsm.ScanFile(*filePath, opts(), func(r *lsm.FileRecord) error {
+		if r.Err != nil {
+			d.Summary.Corrupt++
+			if !*summaryOnly {
+				d.Records = append(d.Records, dumpRecord{Offset: r.Offset, Error: r.Err.Error()})
+			}
+			return nil
+		}
+
+		if r.Indexed {
+			d.Summary.Index = append(d.Summary.Index, dumpIndexEntry{Key: format(r.Key), Offset: r.Offset})
+		}
+
+		if (*start != "" && r.Key < *start) || (*end != "" && r.Key >= *end) {
+			return nil
+		}
+
+		if d.Summary.Records == 0 || r.Key < d.Summary.MinKey {
+			d.Summary.MinKey = r.Key
+		}
+		if d.Summary.Records == 0 || r.Key > d.Summary.MaxKey {
+			d.Summary.MaxKey = r.Key
+		}
+		d.Summary.Records++
+		if r.Deleted {
+			d.Summary.Tombstones++
+		}
+
+		if !*summaryOnly {
+			d.Records = append(d.Records, dumpRecord{Offset: r.Offset, Key: format(r.Key),
+				Value: format(r.Value), Deleted: r.Deleted, Seq: r.Seq,
+				Timestamp: r.Timestamp, Checksum: fmt.Sprintf("%016x", r.Checksum)})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	d.Summary.MinKey = format(d.Summary.MinKey)
+	d.Summary.MaxKey = format(d.Summary.MaxKey)
+	if d.Summary.Records != 0 {
+		d.Summary.TombstoneRatio = float64(d.Summary.Tombstones) / float64(d.Summary.Records)
+	}
+
+	if *asJson {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	}
+
+	for _, r := range d.Records {
+		if r.Error != "" {
+			fmt.Fprintf(out, "offset %d: %s\n", r.Offset, r.Error)
+			continue
+		}
+		fmt.Fprintf(out, "offset %d seq %d deleted %v key %s value %s checksum %s\n",
+			r.Offset, r.Seq, r.Deleted, r.Key, r.Value, r.Checksum)
+	}
+
+	fmt.Fprintf(out, "file %s\n", d.Summary.FilePath)
+	fmt.Fprintf(out, "records %d tombstones %d tombstone ratio %.3f corrupt %d\n",
+		d.Summary.Records, d.Summary.Tombstones, d.Summary.TombstoneRatio, d.Summary.Corrupt)
+	fmt.Fprintf(out, "min key %s max key %s\n", d.Summary.MinKey, d.Summary.MaxKey)
+	for _, e := range d.Summary.Index {
+		fmt.Fprintf(out, "index key %s offset %d\n", e.Key, e.Offset)
+	}
+	return nil
+}
+
+func restore(log log.LogInterface, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	backupPath := fs.String("backup", "", "base backup directory")
+	archivePath := fs.String("archive", "", "archived log segments directory")
+	targetPath := fs.String("target", "", "directory to restore into, must not exist")
+	untilSeq := fs.Uint64("until-seq", 0, "last sequence to replay, 0 means all")
+	untilTime := fs.String("until-time", "", "last write time to replay, RFC3339")
+	opts := keysFlag(fs)
+	fs.Parse(args)
+
+	if *backupPath == "" || *archivePath == "" || *targetPath == "" {
+		fs.Usage()
+		return fmt.Errorf("backup, archive and target are required")
+	}
+
+	untilTimestamp := int64(0)
+	if *untilTime != "" {
+		t, err := time.Parse(time.RFC3339, *untilTime)
+		if err != nil {
+			return err
+		}
+		untilTimestamp = t.UnixNano()
+	}
+
+	return lsm.RestoreLsm(log, *backupPath, *archivePath, *targetPath, *untilSeq, untilTimestamp, opts())
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stderr))
+	defer log.Shutdown()
+
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			err := cmd.run(log, os.Args[2:])
+			if err != nil {
+				log.PfSync(0, "%s error %v", cmd.name, err)
+				log.Shutdown()
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	usage()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/irqlevel/naiv/lib/common/filelog"
+	"github.com/irqlevel/naiv/lib/common/log"
+	"github.com/irqlevel/naiv/lib/common/lsm"
+)
+
+func runDump(log log.LogInterface, args ...string) (string, error) {
+	buf := new(bytes.Buffer)
+	out = buf
+	defer func() { out = os.Stdout }()
+
+	err := sstdump(log, args)
+	return buf.String(), err
+}
+
+func TestSstDump(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestSstDump")
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stderr))
+	defer log.Sync()
+
+	tablePath := filepath.Join(rootPath, "table.sstable")
+	w, err := lsm.NewSsTableWriter(tablePath)
+	if err != nil {
+		t.Fatalf("can't create writer error %v", err)
+		return
+	}
+	for i := 0; i < 1000; i++ {
+		err = w.Set(fmt.Sprintf("key%04d", i), "value")
+		if err != nil {
+			t.Fatalf("can't add key error %v", err)
+			w.Abort()
+			return
+		}
+	}
+	err = w.Finish()
+	if err != nil {
+		t.Fatalf("can't finish writer error %v", err)
+		return
+	}
+
+	text, err := runDump(log, "-file", tablePath)
+	if err != nil {
+		t.Fatalf("can't dump table error %v", err)
+		return
+	}
+	lines := strings.Split(text, "\n")
+	record := regexp.MustCompile(`^offset 0 seq 0 deleted false key key0000 value value checksum [0-9a-f]{16}$`)
+	if !record.MatchString(lines[0]) {
+		t.Fatalf("unexpected record line %q", lines[0])
+		return
+	}
+	if !strings.Contains(text, "records 1000 tombstones 0 tombstone ratio 0.000 corrupt 0\n") ||
+		!strings.Contains(text, "min key key0000 max key key0999\n") ||
+		!strings.Contains(text, "index key key0000 offset 0\n") ||
+		!strings.Contains(text, "index key key0512 offset ") {
+		t.Fatalf("unexpected summary %q", text[strings.Index(text, "file "):])
+		return
+	}
+
+	dataPath := filepath.Join(rootPath, "data")
+	l, err := lsm.NewLsm(log, dataPath)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	err = l.Set("key", "value")
+	l.Close()
+	if err != nil {
+		t.Fatalf("can't set key error %v", err)
+		return
+	}
+
+	// A log has no sparse index
+	text, err = runDump(log, "-file", filepath.Join(dataPath, "lsm.log"), "-json")
+	if err != nil {
+		t.Fatalf("can't dump log error %v", err)
+		return
+	}
+	d := new(dump)
+	err = json.Unmarshal([]byte(text), d)
+	if err != nil {
+		t.Fatalf("can't decode dump error %v", err)
+		return
+	}
+	if len(d.Records) != 1 || d.Records[0].Key != "key" || d.Records[0].Seq == 0 ||
+		len(d.Records[0].Checksum) != 16 || d.Records[0].Error != "" {
+		t.Fatalf("unexpected log records %+v", d.Records)
+		return
+	}
+	if d.Summary.Records != 1 || len(d.Summary.Index) != 0 {
+		t.Fatalf("unexpected log summary %+v", d.Summary)
+		return
+	}
+}